@@ -1,8 +1,8 @@
 package api
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,15 +11,19 @@ import (
 	"strings"
 	"time"
 
+	"github.com/elastic/beats/v7/libbeat/common/transport/httpcommon"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
 	"github.com/hashicorp/go-retryablehttp"
 	"go.1password.io/eventsapibeat/utils"
 	"go.1password.io/eventsapibeat/version"
+	"golang.org/x/time/rate"
 )
 
 var DefaultUserAgent = "1Password Events API Beats / " + version.Version
 
 type Client struct {
 	httpClient *http.Client
+	baseURL    string
 }
 
 type SignInAttemptResponse struct {
@@ -167,16 +171,102 @@ func RetryPolicyWithContextErrors(ctx context.Context, resp *http.Response, err
 	return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
 }
 
-func NewClient(logger retryablehttp.LeveledLogger, insecureSkipVerify bool) (*Client, error) {
+// lastResponseErrorHandler hands the last response back once retries are
+// exhausted, so that it surfaces as an *Error with the reason for the failure.
+// When the retry policy gave up with an error, such as a cancelled context or
+// max_elapsed being exceeded, that error is returned wrapping the *Error.
+func lastResponseErrorHandler(resp *http.Response, err error, numTries int) (*http.Response, error) {
+	if resp != nil && err == nil {
+		return resp, nil
+	}
+	if resp != nil {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("giving up after %d attempt(s): %w. %w", numTries, err, newError(resp))
+		}
+	}
+	if err == nil {
+		return nil, fmt.Errorf("giving up after %d attempt(s)", numTries)
+	}
+	return nil, fmt.Errorf("giving up after %d attempt(s): %w", numTries, err)
+}
+
+type requestStartKey struct{}
+
+type noRetryKey struct{}
+
+// WithoutRetries returns a context whose requests are sent only once, whatever
+// the retry settings of the client.
+func WithoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+// retryPolicyWithMaxElapsed extends RetryPolicyWithContextErrors to give up
+// once maxElapsed has passed since the request was first attempted, or right
+// away for requests made WithoutRetries.
+func retryPolicyWithMaxElapsed(maxElapsed time.Duration) retryablehttp.CheckRetry {
+	return func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		retry, checkErr := RetryPolicyWithContextErrors(ctx, resp, err)
+		if retry && ctx.Value(noRetryKey{}) != nil {
+			return false, checkErr
+		}
+		if !retry || maxElapsed <= 0 {
+			return retry, checkErr
+		}
+		if start, ok := ctx.Value(requestStartKey{}).(time.Time); ok && time.Since(start) > maxElapsed {
+			return false, fmt.Errorf("giving up after retrying for %s", maxElapsed)
+		}
+		return retry, checkErr
+	}
+}
+
+// ClientConfig holds the settings of a Client.
+type ClientConfig struct {
+	// Transport configures TLS, proxies and timeouts. The defaults of
+	// retryablehttp are used when it is nil.
+	Transport *httpcommon.HTTPTransportSettings
+	// MaxRetries is the number of times a failed request is retried.
+	MaxRetries int
+	// MaxRetryElapsed bounds the total time spent on a request and its
+	// retries. Zero means no limit.
+	MaxRetryElapsed time.Duration
+	// Metrics receives the rate limiting metrics. An unregistered registry is
+	// used when it is nil.
+	Metrics *monitoring.Registry
+	// RequestsPerSecond caps the rate of requests, retries included, sent by
+	// the client and the clients derived from it. Zero means no limit.
+	RequestsPerSecond float64
+}
+
+func NewClient(logger retryablehttp.LeveledLogger, config ClientConfig) (*Client, error) {
+	metrics := config.Metrics
+	if metrics == nil {
+		metrics = monitoring.NewRegistry()
+	}
+	limiter := newRateLimiter(logger, metrics)
+
 	retryHTTPClient := retryablehttp.NewClient()
-	retryHTTPClient.RetryMax = 1000000
-	retryHTTPClient.CheckRetry = RetryPolicyWithContextErrors
+	retryHTTPClient.RetryMax = config.MaxRetries
+	retryHTTPClient.CheckRetry = retryPolicyWithMaxElapsed(config.MaxRetryElapsed)
+	retryHTTPClient.Backoff = limiter.Backoff
 	retryHTTPClient.Logger = logger
-	if httpTransport, ok := retryHTTPClient.HTTPClient.Transport.(*http.Transport); insecureSkipVerify && ok {
-		httpTransport.TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: insecureSkipVerify,
+	retryHTTPClient.ErrorHandler = lastResponseErrorHandler
+	if config.Transport != nil {
+		transport, err := config.Transport.RoundTripper()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create transport. %w", err)
 		}
+		retryHTTPClient.HTTPClient.Transport = transport
+		retryHTTPClient.HTTPClient.Timeout = config.Transport.Timeout
+	}
+	transport := &throttledTransport{
+		base:    retryHTTPClient.HTTPClient.Transport,
+		limiter: limiter,
 	}
+	if config.RequestsPerSecond > 0 {
+		transport.budget = rate.NewLimiter(rate.Limit(config.RequestsPerSecond), 1)
+	}
+	retryHTTPClient.HTTPClient.Transport = transport
 
 	client := &Client{
 		httpClient: retryHTTPClient.StandardClient(),
@@ -185,6 +275,16 @@ func NewClient(logger retryablehttp.LeveledLogger, insecureSkipVerify bool) (*Cl
 	return client, nil
 }
 
+// WithBaseURL returns a client that sends its requests to baseURL, such as
+// https://events.1password.com, instead of the URL derived from the audience
+// of the token. The returned client shares the transport and the rate limits
+// of c.
+func (c *Client) WithBaseURL(baseURL string) *Client {
+	client := *c
+	client.baseURL = strings.TrimSuffix(baseURL, "/")
+	return &client
+}
+
 func (c *Client) HTTPClient() *http.Client {
 	return c.httpClient
 }
@@ -198,10 +298,10 @@ func (c *Client) Introspect(ctx context.Context, bearerToken string) (*Introspec
 	if err != nil {
 		return nil, err
 	}
-	_ = response.Body.Close()
+	defer response.Body.Close()
 
 	if response.StatusCode != 200 {
-		return nil, fmt.Errorf("unexpected status code: %s", response.Status)
+		return nil, newError(response)
 	}
 
 	var introspectResponse IntrospectResponse
@@ -213,21 +313,13 @@ func (c *Client) Introspect(ctx context.Context, bearerToken string) (*Introspec
 	return &introspectResponse, nil
 }
 
-func (c *Client) SignInAttempts(ctx context.Context, bearerToken string, cursor string) (*SignInAttemptResponse, error) {
-	request, err := c.newAPIRequest(ctx, http.MethodPost, bearerToken, "/api/v1/signinattempts", strings.NewReader(cursor))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new API request. %w", err)
-	}
-	response, err := c.httpClient.Do(request)
+func (c *Client) SignInAttempts(ctx context.Context, bearerToken string, cursor Cursor) (*SignInAttemptResponse, error) {
+	response, err := c.postCursor(ctx, bearerToken, SignInAttemptsEventType.Path, cursor)
 	if err != nil {
 		return nil, err
 	}
 	defer response.Body.Close()
 
-	if response.StatusCode != 200 {
-		return nil, fmt.Errorf("unexpected status code: %s", response.Status)
-	}
-
 	var signInAttemptResponse SignInAttemptResponse
 	err = json.NewDecoder(response.Body).Decode(&signInAttemptResponse)
 	if err != nil {
@@ -237,21 +329,13 @@ func (c *Client) SignInAttempts(ctx context.Context, bearerToken string, cursor
 	return &signInAttemptResponse, nil
 }
 
-func (c *Client) ItemUsages(ctx context.Context, bearerToken string, cursor string) (*ItemUsageResponse, error) {
-	request, err := c.newAPIRequest(ctx, http.MethodPost, bearerToken, "/api/v1/itemusages", strings.NewReader(cursor))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new API request. %w", err)
-	}
-	response, err := c.httpClient.Do(request)
+func (c *Client) ItemUsages(ctx context.Context, bearerToken string, cursor Cursor) (*ItemUsageResponse, error) {
+	response, err := c.postCursor(ctx, bearerToken, ItemUsagesEventType.Path, cursor)
 	if err != nil {
 		return nil, err
 	}
 	defer response.Body.Close()
 
-	if response.StatusCode != 200 {
-		return nil, fmt.Errorf("unexpected status code: %s", response.Status)
-	}
-
 	var itemUsageResponse ItemUsageResponse
 	err = json.NewDecoder(response.Body).Decode(&itemUsageResponse)
 	if err != nil {
@@ -261,21 +345,13 @@ func (c *Client) ItemUsages(ctx context.Context, bearerToken string, cursor stri
 	return &itemUsageResponse, nil
 }
 
-func (c *Client) AuditEvents(ctx context.Context, bearerToken string, cursor string) (*AuditEventsResponse, error) {
-	request, err := c.newAPIRequest(ctx, http.MethodPost, bearerToken, "/api/v1/auditevents", strings.NewReader(cursor))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new API request. %w", err)
-	}
-	response, err := c.httpClient.Do(request)
+func (c *Client) AuditEvents(ctx context.Context, bearerToken string, cursor Cursor) (*AuditEventsResponse, error) {
+	response, err := c.postCursor(ctx, bearerToken, AuditEventsEventType.Path, cursor)
 	if err != nil {
 		return nil, err
 	}
 	defer response.Body.Close()
 
-	if response.StatusCode != 200 {
-		return nil, fmt.Errorf("unexpected status code: %s", response.Status)
-	}
-
 	var auditEventsResponse AuditEventsResponse
 	err = json.NewDecoder(response.Body).Decode(&auditEventsResponse)
 	if err != nil {
@@ -285,17 +361,62 @@ func (c *Client) AuditEvents(ctx context.Context, bearerToken string, cursor str
 	return &auditEventsResponse, nil
 }
 
-func (c *Client) newAPIRequest(ctx context.Context, method string, bearerToken string, path string, body io.Reader) (*http.Request, error) {
-	jwt, err := utils.ParseJWTClaims(bearerToken)
+// Events fetches the page of events of type t that follows cursor.
+func (c *Client) Events(ctx context.Context, bearerToken string, t *EventType, cursor Cursor) (*Page, error) {
+	response, err := c.postCursor(ctx, bearerToken, t.Path, cursor)
 	if err != nil {
 		return nil, err
 	}
+	defer response.Body.Close()
+
+	page, err := t.Decode(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response. %w", err)
+	}
+
+	return page, nil
+}
+
+// postCursor posts cursor to an events endpoint. The caller must close the
+// body of the returned response.
+func (c *Client) postCursor(ctx context.Context, bearerToken string, path string, cursor Cursor) (*http.Response, error) {
+	body, err := json.Marshal(cursor.request())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cursor. %w", err)
+	}
 
-	url, err := jwt.GetEventsURL()
+	request, err := c.newAPIRequest(ctx, http.MethodPost, bearerToken, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new API request. %w", err)
+	}
+	response, err := c.httpClient.Do(request)
 	if err != nil {
 		return nil, err
 	}
 
+	if response.StatusCode != 200 {
+		defer response.Body.Close()
+		return nil, newError(response)
+	}
+
+	return response, nil
+}
+
+func (c *Client) newAPIRequest(ctx context.Context, method string, bearerToken string, path string, body io.Reader) (*http.Request, error) {
+	url := c.baseURL
+	if url == "" {
+		jwt, err := utils.ParseJWTClaims(bearerToken)
+		if err != nil {
+			return nil, err
+		}
+
+		url, err = jwt.GetEventsURL()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx = context.WithValue(ctx, requestStartKey{}, time.Now())
 	request, _ := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s%s", url, path), body)
 	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", bearerToken))
 	request.Header.Add("User-Agent", DefaultUserAgent)
@@ -0,0 +1,383 @@
+// Package apitest provides an in-process fake of the 1Password Events API for
+// end-to-end tests of the beat and of code built on the api package.
+package apitest
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.1password.io/eventsapibeat/api"
+	"go.1password.io/eventsapibeat/utils"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// Fault replaces the normal response of one request.
+type Fault struct {
+	// StatusCode of the response. It defaults to 200 for malformed pages and
+	// to 500 otherwise.
+	StatusCode int
+	// RetryAfter is sent as the Retry-After header when it is not zero.
+	RetryAfter time.Duration
+	// Body of the response. An Events API style JSON error is sent when it is
+	// empty.
+	Body string
+	// Malformed sends a truncated JSON page instead of an error.
+	Malformed bool
+}
+
+// Server is a fake Events API. It serves the endpoints of every registered
+// api.EventType, and /api/auth/introspect, to tokens minted with Token.
+//
+// Events are served in the order of their timestamps. Reset cursors select
+// the events from start_time up to, but excluding, end_time. Continuation
+// cursors resume after the last event returned, so events added later are
+// returned by the next request, like new events are by the Events API.
+type Server struct {
+	URL string
+
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	latency  time.Duration
+	streams  map[string]*fakeStream
+	faults   map[string][]Fault
+	requests map[string]int
+	revoked  map[string]bool
+}
+
+type fakeStream struct {
+	featureScope string
+	events       []fakeEvent
+}
+
+type fakeEvent struct {
+	timestamp time.Time
+	raw       json.RawMessage
+}
+
+// fakeCursor is the state behind the opaque continuation cursors.
+type fakeCursor struct {
+	Position int       `json:"p"`
+	Limit    int       `json:"l"`
+	EndTime  time.Time `json:"e,omitempty"`
+}
+
+// NewServer starts a fake Events API. It panics when the server can't be
+// started, like httptest.NewServer. Call Close when done.
+func NewServer() *Server {
+	key, err := NewSigningKey()
+	if err != nil {
+		panic(fmt.Sprintf("apitest: failed to generate signing key: %v", err))
+	}
+
+	s := &Server{
+		key:      key,
+		streams:  map[string]*fakeStream{},
+		faults:   map[string][]Fault{},
+		requests: map[string]int{},
+		revoked:  map[string]bool{},
+	}
+	for _, t := range api.EventTypes() {
+		s.streams[t.Path] = &fakeStream{featureScope: t.FeatureScope}
+	}
+
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Client returns an api.Client that sends its requests to the server.
+func (s *Server) Client(config api.ClientConfig) (*api.Client, error) {
+	client, err := api.NewClient(nil, config)
+	if err != nil {
+		return nil, err
+	}
+	return client.WithBaseURL(s.URL), nil
+}
+
+// Token mints a token accepted by the server, whose audience is the host of
+// the server and which carries features.
+func (s *Server) Token(features ...string) string {
+	u, _ := url.Parse(s.URL)
+	token, err := MintToken(s.key, TokenClaims{Audience: u.Host, Features: features})
+	if err != nil {
+		panic(fmt.Sprintf("apitest: failed to mint token: %v", err))
+	}
+	return token
+}
+
+// Revoke makes the server reject token with 401 Unauthorized.
+func (s *Server) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[token] = true
+}
+
+// Handle serves an endpoint that is not registered with the api package.
+func (s *Server) Handle(t *api.EventType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.streams[t.Path]; !ok {
+		s.streams[t.Path] = &fakeStream{featureScope: t.FeatureScope}
+	}
+}
+
+// AddEvents adds fixtures to the endpoint at path. Events are encoded to
+// JSON and must have a timestamp field, such as api.SignInAttempt,
+// api.ItemUsage and api.AuditEvent.
+func (s *Server) AddEvents(path string, events ...interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.streams[path]
+	if !ok {
+		return fmt.Errorf("apitest: no endpoint at %s", path)
+	}
+
+	for _, e := range events {
+		raw, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("apitest: failed to encode event. %w", err)
+		}
+		var item struct {
+			Timestamp time.Time `json:"timestamp"`
+		}
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return fmt.Errorf("apitest: event has no valid timestamp. %w", err)
+		}
+		stream.events = append(stream.events, fakeEvent{timestamp: item.Timestamp, raw: raw})
+	}
+	sort.SliceStable(stream.events, func(i, j int) bool {
+		return stream.events[i].timestamp.Before(stream.events[j].timestamp)
+	})
+	return nil
+}
+
+// SetLatency delays every response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// InjectFaults makes the next requests to path fail, one fault per request.
+func (s *Server) InjectFaults(path string, faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[path] = append(s.faults[path], faults...)
+}
+
+// Requests returns the number of requests received for path.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	latency := s.latency
+	var fault *Fault
+	if faults := s.faults[r.URL.Path]; len(faults) > 0 {
+		fault = &faults[0]
+		s.faults[r.URL.Path] = faults[1:]
+	}
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if fault != nil {
+		writeFault(w, fault)
+		return
+	}
+
+	claims, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+
+	if r.URL.Path == "/api/auth/introspect" && r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, api.IntrospectResponse{
+			UUID:     claims.UUID,
+			IssuedAt: claims.IssuedAt,
+			Features: claims.Features,
+		})
+		return
+	}
+
+	s.mu.Lock()
+	stream, ok := s.streams[r.URL.Path]
+	s.mu.Unlock()
+	if !ok || r.Method != http.MethodPost {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if !utils.Features(claims.Features).Contains(stream.featureScope) {
+		writeError(w, http.StatusForbidden, "token does not have access to "+stream.featureScope)
+		return
+	}
+
+	s.servePage(w, r, stream)
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) (*TokenClaims, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	s.mu.Lock()
+	revoked := s.revoked[token]
+	s.mu.Unlock()
+
+	claims, err := parseToken(s.key, token)
+	if err != nil || revoked {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	return claims, true
+}
+
+func (s *Server) servePage(w http.ResponseWriter, r *http.Request, stream *fakeStream) {
+	var request struct {
+		Cursor    string     `json:"cursor"`
+		Limit     int        `json:"limit"`
+		StartTime *time.Time `json:"start_time"`
+		EndTime   *time.Time `json:"end_time"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid cursor: "+err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var cursor fakeCursor
+	if request.Cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(request.Cursor)
+		if err == nil {
+			err = json.Unmarshal(b, &cursor)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	} else {
+		cursor.Limit = request.Limit
+		if cursor.Limit <= 0 {
+			cursor.Limit = defaultLimit
+		}
+		if cursor.Limit > maxLimit {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit can't be more than %d", maxLimit))
+			return
+		}
+		if request.StartTime != nil {
+			cursor.Position = sort.Search(len(stream.events), func(i int) bool {
+				return !stream.events[i].timestamp.Before(*request.StartTime)
+			})
+		}
+		if request.EndTime != nil {
+			cursor.EndTime = *request.EndTime
+		}
+	}
+
+	end := len(stream.events)
+	if !cursor.EndTime.IsZero() {
+		end = sort.Search(len(stream.events), func(i int) bool {
+			return !stream.events[i].timestamp.Before(cursor.EndTime)
+		})
+	}
+	if cursor.Position > end {
+		cursor.Position = end
+	}
+
+	last := cursor.Position + cursor.Limit
+	if last > end {
+		last = end
+	}
+	items := make([]json.RawMessage, 0, last-cursor.Position)
+	for _, e := range stream.events[cursor.Position:last] {
+		items = append(items, e.raw)
+	}
+
+	next := cursor
+	next.Position = last
+	b, _ := json.Marshal(next)
+
+	writeJSON(w, http.StatusOK, struct {
+		Cursor  string            `json:"cursor"`
+		HasMore bool              `json:"has_more"`
+		Items   []json.RawMessage `json:"items"`
+	}{
+		Cursor:  base64.RawURLEncoding.EncodeToString(b),
+		HasMore: last < end,
+		Items:   items,
+	})
+}
+
+func writeFault(w http.ResponseWriter, fault *Fault) {
+	if fault.RetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(fault.RetryAfter.Round(time.Second)/time.Second)))
+	}
+
+	statusCode := fault.StatusCode
+	if fault.Malformed {
+		if statusCode == 0 {
+			statusCode = http.StatusOK
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		_, _ = w.Write([]byte(`{"cursor": "`))
+		return
+	}
+
+	if statusCode == 0 {
+		statusCode = http.StatusInternalServerError
+	}
+	if fault.Body != "" {
+		w.WriteHeader(statusCode)
+		_, _ = w.Write([]byte(fault.Body))
+		return
+	}
+	writeError(w, statusCode, http.StatusText(statusCode))
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	var body struct {
+		Error struct {
+			Message string
+		}
+	}
+	body.Error.Message = message
+	writeJSON(w, statusCode, body)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,91 @@
+package apitest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// TokenClaims are the claims of a test Events API token.
+type TokenClaims struct {
+	UUID     string
+	IssuedAt time.Time
+	// Audience is the host of the Events API, e.g. events.1password.com.
+	Audience string
+	// Features are the 1password.com/fts features, e.g. auditevents.
+	Features []string
+}
+
+type tokenClaims struct {
+	ID       string           `json:"jti"`
+	IssuedAt *jwt.NumericDate `json:"iat"`
+	Audience []string         `json:"aud"`
+	Features []string         `json:"1password.com/fts"`
+}
+
+// NewSigningKey generates a P-256 key for MintToken.
+func NewSigningKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// MintToken returns an ES256 signed bearer token carrying claims. A random
+// UUID and the current time are used when they are not set.
+func MintToken(key *ecdsa.PrivateKey, claims TokenClaims) (string, error) {
+	if claims.UUID == "" {
+		claims.UUID = NewUUID()
+	}
+	if claims.IssuedAt.IsZero() {
+		claims.IssuedAt = time.Now()
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", fmt.Errorf("failed to create signer. %w", err)
+	}
+
+	return jwt.Signed(signer).Claims(tokenClaims{
+		ID:       claims.UUID,
+		IssuedAt: jwt.NewNumericDate(claims.IssuedAt),
+		Audience: []string{claims.Audience},
+		Features: claims.Features,
+	}).Serialize()
+}
+
+// parseToken verifies the signature of token with key and returns its claims.
+func parseToken(key *ecdsa.PrivateKey, token string) (*TokenClaims, error) {
+	t, err := jwt.ParseSigned(token, []jose.SignatureAlgorithm{jose.ES256})
+	if err != nil {
+		return nil, err
+	}
+
+	var claims tokenClaims
+	if err := t.Claims(&key.PublicKey, &claims); err != nil {
+		return nil, err
+	}
+
+	parsed := &TokenClaims{
+		UUID:     claims.ID,
+		Features: claims.Features,
+	}
+	if claims.IssuedAt != nil {
+		parsed.IssuedAt = claims.IssuedAt.Time()
+	}
+	if len(claims.Audience) > 0 {
+		parsed.Audience = claims.Audience[0]
+	}
+	return parsed, nil
+}
+
+// NewUUID returns a random identifier in the format used by the Events API:
+// 16 random bytes in unpadded base32, 26 characters long.
+func NewUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
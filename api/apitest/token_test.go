@@ -0,0 +1,57 @@
+package apitest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMintToken(t *testing.T) {
+	key, err := NewSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		claims TokenClaims
+	}{
+		{name: "all claims", claims: TokenClaims{UUID: NewUUID(), IssuedAt: issued, Audience: "events.1password.com", Features: []string{"auditevents"}}},
+		{name: "several features", claims: TokenClaims{UUID: NewUUID(), IssuedAt: issued, Audience: "localhost", Features: []string{"signinattempts", "itemusages"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := MintToken(key, tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := parseToken(key, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.UUID != tt.claims.UUID || !claims.IssuedAt.Equal(tt.claims.IssuedAt) || claims.Audience != tt.claims.Audience || len(claims.Features) != len(tt.claims.Features) {
+				t.Errorf("parsed claims %+v, want %+v", claims, tt.claims)
+			}
+		})
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		uuid := NewUUID()
+		if len(uuid) != 26 {
+			t.Fatalf("NewUUID returned %q, want 26 characters", uuid)
+		}
+		for _, r := range uuid {
+			if !(r >= 'A' && r <= 'Z' || r >= '2' && r <= '7') {
+				t.Fatalf("NewUUID returned %q, which is not base32", uuid)
+			}
+		}
+		if seen[uuid] {
+			t.Fatalf("NewUUID returned %q twice", uuid)
+		}
+		seen[uuid] = true
+	}
+}
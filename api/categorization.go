@@ -0,0 +1,174 @@
+package api
+
+// ECS event.module and event.provider of every built-in event, and the
+// event.dataset of each built-in stream.
+const (
+	ECSModule   = "1password"
+	ECSProvider = "1password"
+
+	SignInAttemptsDataset = ECSModule + ".signin_attempts"
+	ItemUsagesDataset     = ECSModule + ".item_usages"
+	AuditEventsDataset    = ECSModule + ".audit_events"
+)
+
+// ECS categorisation values used by the tables below.
+const (
+	ecsKindEvent = "event"
+
+	ecsCategoryAuthentication = "authentication"
+	ecsCategoryConfiguration  = "configuration"
+	ecsCategoryFile           = "file"
+	ecsCategoryIAM            = "iam"
+
+	ecsTypeAccess   = "access"
+	ecsTypeChange   = "change"
+	ecsTypeCreation = "creation"
+	ecsTypeDeletion = "deletion"
+	ecsTypeGroup    = "group"
+	ecsTypeInfo     = "info"
+	ecsTypeStart    = "start"
+	ecsTypeUser     = "user"
+
+	ecsOutcomeSuccess = "success"
+	ecsOutcomeFailure = "failure"
+	ecsOutcomeUnknown = "unknown"
+)
+
+// ecsCategorization holds the event.category, event.type and event.outcome of
+// an event.
+type ecsCategorization struct {
+	Category []string
+	Type     []string
+	Outcome  string
+}
+
+func authentication(outcome string) ecsCategorization {
+	return ecsCategorization{
+		Category: []string{ecsCategoryAuthentication},
+		Type:     []string{ecsTypeStart},
+		Outcome:  outcome,
+	}
+}
+
+// signInAttemptCategories maps the category of a sign-in attempt to its ECS
+// categorisation.
+var signInAttemptCategories = map[string]ecsCategorization{
+	"success":                   authentication(ecsOutcomeSuccess),
+	"firewall_reported_success": authentication(ecsOutcomeSuccess),
+	"credentials_failed":        authentication(ecsOutcomeFailure),
+	"mfa_failed":                authentication(ecsOutcomeFailure),
+	"sso_failed":                authentication(ecsOutcomeFailure),
+	"modern_version_failed":     authentication(ecsOutcomeFailure),
+	"firewall_failed":           authentication(ecsOutcomeFailure),
+}
+
+func fileAccess(types ...string) ecsCategorization {
+	return ecsCategorization{
+		Category: []string{ecsCategoryFile},
+		Type:     types,
+		Outcome:  ecsOutcomeSuccess,
+	}
+}
+
+// itemUsageActions maps the action of an item usage to its ECS
+// categorisation. Items are treated as files, except for picking an SSO
+// provider, which only reveals how the user signs in.
+var itemUsageActions = map[string]ecsCategorization{
+	"fill":                 fileAccess(ecsTypeAccess),
+	"sso-fill":             fileAccess(ecsTypeAccess),
+	"reveal":               fileAccess(ecsTypeAccess),
+	"secure-copy":          fileAccess(ecsTypeAccess),
+	"export":               fileAccess(ecsTypeAccess),
+	"share":                fileAccess(ecsTypeAccess),
+	"server-fetch":         fileAccess(ecsTypeAccess),
+	"enter-item-edit-mode": fileAccess(ecsTypeAccess),
+	"server-create":        fileAccess(ecsTypeCreation),
+	"server-update":        fileAccess(ecsTypeChange),
+	"select-sso-provider": {
+		Category: []string{ecsCategoryIAM},
+		Type:     []string{ecsTypeInfo},
+		Outcome:  ecsOutcomeSuccess,
+	},
+}
+
+// auditEventObjectTypes maps the object type of an audit event to its ECS
+// category, and to the ECS type added to the one of its action. Object types
+// that are not listed are configuration changes.
+var auditEventObjectTypes = map[string]struct {
+	Category string
+	Type     string
+}{
+	"user":   {ecsCategoryIAM, ecsTypeUser},
+	"invite": {ecsCategoryIAM, ecsTypeUser},
+	"sa":     {ecsCategoryIAM, ecsTypeUser},
+	"group":  {ecsCategoryIAM, ecsTypeGroup},
+	"gm":     {ecsCategoryIAM, ecsTypeGroup},
+	"uva":    {ecsCategoryIAM, ecsTypeUser},
+	"gva":    {ecsCategoryIAM, ecsTypeGroup},
+}
+
+// auditEventActions maps the action of an audit event to its ECS type. Actions
+// that are not listed are changes.
+var auditEventActions = map[string]string{
+	"create": ecsTypeCreation,
+	"delete": ecsTypeDeletion,
+	"purge":  ecsTypeDeletion,
+	"trash":  ecsTypeDeletion,
+}
+
+// categorizeSignInAttempt returns the ECS categorisation of a sign-in attempt
+// of the given category.
+func categorizeSignInAttempt(category string) ecsCategorization {
+	if c, ok := signInAttemptCategories[category]; ok {
+		return c
+	}
+	return authentication(ecsOutcomeUnknown)
+}
+
+// categorizeItemUsage returns the ECS categorisation of an item usage with the
+// given action.
+func categorizeItemUsage(action string) ecsCategorization {
+	if c, ok := itemUsageActions[action]; ok {
+		return c
+	}
+	return fileAccess(ecsTypeAccess)
+}
+
+// categorizeAuditEvent returns the ECS categorisation of an audit event with
+// the given action and object type.
+func categorizeAuditEvent(action, objectType string) ecsCategorization {
+	actionType, ok := auditEventActions[action]
+	if !ok {
+		actionType = ecsTypeChange
+	}
+
+	object, ok := auditEventObjectTypes[objectType]
+	if !ok {
+		return ecsCategorization{
+			Category: []string{ecsCategoryConfiguration},
+			Type:     []string{actionType},
+			Outcome:  ecsOutcomeSuccess,
+		}
+	}
+	return ecsCategorization{
+		Category: []string{object.Category},
+		Type:     []string{actionType, object.Type},
+		Outcome:  ecsOutcomeSuccess,
+	}
+}
+
+// ecsEvent returns the event field set of an event of dataset, with the given
+// UUID, action and categorisation.
+func ecsEvent(dataset, uuid, action string, c ecsCategorization) ECSEvent {
+	return ECSEvent{
+		ID:       uuid,
+		Kind:     ecsKindEvent,
+		Category: c.Category,
+		Type:     c.Type,
+		Outcome:  c.Outcome,
+		Action:   action,
+		Provider: ECSProvider,
+		Dataset:  dataset,
+		Module:   ECSModule,
+	}
+}
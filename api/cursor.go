@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxLimit is the largest number of events the Events API returns per page.
+const MaxLimit = 1000
+
+// Cursor is the body of a request to an events endpoint. It takes one of two
+// forms: a reset cursor selects events by Limit, StartTime and EndTime, and a
+// continuation cursor resumes after the page that returned Cursor.
+type Cursor struct {
+	// Cursor is the opaque cursor returned with the previous page. It can't be
+	// combined with the other fields.
+	Cursor string
+	// Limit is the number of events per page, up to MaxLimit. The Events API
+	// default is used when it is 0.
+	Limit int
+	// StartTime is the time of the oldest event to return, if not nil.
+	StartTime *time.Time
+	// EndTime is the time after the newest event to return, if not nil.
+	EndTime *time.Time
+	// LastEventTime is the time of the newest event of the pages read up to a
+	// continuation cursor. It is kept by the cursor stores, to resume from
+	// when the Events API rejects the cursor, and is not sent to the Events
+	// API.
+	LastEventTime *time.Time
+}
+
+// ContinuationCursor returns the cursor that resumes after the page that
+// returned cursor. The Events API returns a cursor with every page, an empty
+// one would start over from the beginning and is rejected.
+func ContinuationCursor(cursor string) (Cursor, error) {
+	if cursor == "" {
+		return Cursor{}, fmt.Errorf("the Events API returned an empty cursor")
+	}
+	return Cursor{Cursor: cursor}, nil
+}
+
+// IsContinuation reports whether c resumes after a previous page.
+func (c Cursor) IsContinuation() bool {
+	return c.Cursor != ""
+}
+
+func (c Cursor) Validate() error {
+	if c.IsContinuation() {
+		if c.Limit != 0 || c.StartTime != nil || c.EndTime != nil {
+			return fmt.Errorf("cursor can't be combined with limit, start_time or end_time")
+		}
+		return nil
+	}
+	if c.LastEventTime != nil {
+		return fmt.Errorf("last_event_time requires a cursor")
+	}
+	if c.Limit < 0 || c.Limit > MaxLimit {
+		return fmt.Errorf("limit can't be negative or more than %d", MaxLimit)
+	}
+	if c.StartTime != nil && c.EndTime != nil && !c.EndTime.After(*c.StartTime) {
+		return fmt.Errorf("end_time must be after start_time")
+	}
+	return nil
+}
+
+// Encode returns the JSON form of c, as kept by the cursor stores. It fails
+// when c is not valid.
+func (c Cursor) Encode() (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// request returns c without the fields that are not sent to the Events API.
+func (c Cursor) request() Cursor {
+	c.LastEventTime = nil
+	return c
+}
+
+type cursorJSON struct {
+	Cursor        string     `json:"cursor,omitempty"`
+	Limit         int        `json:"limit,omitempty"`
+	StartTime     *time.Time `json:"start_time,omitempty"`
+	EndTime       *time.Time `json:"end_time,omitempty"`
+	LastEventTime *time.Time `json:"last_event_time,omitempty"`
+}
+
+func (c Cursor) MarshalJSON() ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(cursorJSON(c))
+}
+
+func (c *Cursor) UnmarshalJSON(b []byte) error {
+	var decoded cursorJSON
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return err
+	}
+	if err := Cursor(decoded).Validate(); err != nil {
+		return err
+	}
+	*c = Cursor(decoded)
+	return nil
+}
+
+// ParseCursor parses the JSON form of a cursor, such as the starting_cursor
+// setting or the content of a cursor state file. Unknown fields are rejected.
+func ParseCursor(s string) (Cursor, error) {
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.DisallowUnknownFields()
+
+	var c Cursor
+	var decoded cursorJSON
+	if err := decoder.Decode(&decoded); err != nil {
+		return c, fmt.Errorf("invalid cursor %q. %w", s, err)
+	}
+	if err := Cursor(decoded).Validate(); err != nil {
+		return c, fmt.Errorf("invalid cursor %q. %w", s, err)
+	}
+	return Cursor(decoded), nil
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+// Field types understood by FieldMapping.Type.
+const (
+	FieldTypeAuto    = ""
+	FieldTypeKeyword = "keyword"
+	FieldTypeLong    = "long"
+	FieldTypeDouble  = "double"
+	FieldTypeBoolean = "boolean"
+	FieldTypeDate    = "date"
+	FieldTypeIP      = "ip"
+)
+
+const timestampField = "@timestamp"
+
+// FieldMapping copies the value found at the dotted path From of an item to
+// the dotted event field To, converting it to Type. Mapping to @timestamp sets
+// the event timestamp.
+type FieldMapping struct {
+	From string
+	To   string
+	Type string
+}
+
+// NewCustomEventType describes an endpoint that is not built into the beat.
+// Its items are decoded generically and mapped to event fields with fields.
+// Without any mapping, the whole item is stored under the onepassword field
+// set.
+func NewCustomEventType(name, path, featureScope string, fields []FieldMapping) (*EventType, error) {
+	for _, f := range fields {
+		if f.From == "" || f.To == "" {
+			return nil, fmt.Errorf("field mappings of %s need both from and to", name)
+		}
+		switch f.Type {
+		case FieldTypeAuto, FieldTypeKeyword, FieldTypeLong, FieldTypeDouble, FieldTypeBoolean, FieldTypeDate, FieldTypeIP:
+		default:
+			return nil, fmt.Errorf("unknown type %q for field %s of %s", f.Type, f.To, name)
+		}
+		if f.To == timestampField && f.Type != FieldTypeAuto && f.Type != FieldTypeDate {
+			return nil, fmt.Errorf("%s of %s must be a date", timestampField, name)
+		}
+	}
+
+	return &EventType{
+		Name:         name,
+		ConfigKey:    name,
+		Path:         path,
+		FeatureScope: featureScope,
+		Dataset:      customDataset(name),
+		Decode: func(r io.Reader) (*Page, error) {
+			var response struct {
+				Cursor  string            `json:"cursor"`
+				HasMore bool              `json:"has_more"`
+				Items   []json.RawMessage `json:"items"`
+			}
+			if err := json.NewDecoder(r).Decode(&response); err != nil {
+				return nil, err
+			}
+
+			page := &Page{
+				Cursor:  response.Cursor,
+				HasMore: response.HasMore,
+				Events:  make([]Event, len(response.Items)),
+				Raw:     response.Items,
+			}
+			for i, raw := range response.Items {
+				var item map[string]interface{}
+				if err := json.Unmarshal(raw, &item); err != nil {
+					return nil, err
+				}
+				page.Events[i] = &CustomEvent{Item: item, Fields: fields}
+			}
+			return page, nil
+		},
+	}, nil
+}
+
+// CustomEvent is an item of an endpoint described by NewCustomEventType.
+type CustomEvent struct {
+	Item   common.MapStr
+	Fields []FieldMapping
+}
+
+// EventUUID returns the uuid field of the item, as found in the items of the
+// built-in endpoints.
+func (i *CustomEvent) EventUUID() string {
+	uuid, _ := i.Item["uuid"].(string)
+	return uuid
+}
+
+func (i *CustomEvent) BeatEvent() *beat.Event {
+	e := &beat.Event{
+		Fields: common.MapStr{},
+	}
+
+	if len(i.Fields) == 0 {
+		e.Fields[CustomFieldSet] = i.Item
+	}
+
+	var errs []string
+	for _, f := range i.Fields {
+		raw, err := i.Item.GetValue(f.From)
+		if err != nil || raw == nil {
+			continue
+		}
+
+		if f.To == timestampField {
+			t, err := convertField(raw, FieldTypeDate)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("failed to map %s to %s. %v", f.From, f.To, err))
+				continue
+			}
+			e.Timestamp = t.(time.Time)
+			continue
+		}
+
+		v, err := convertField(raw, f.Type)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to map %s to %s. %v", f.From, f.To, err))
+			continue
+		}
+		_, _ = e.Fields.Put(f.To, v)
+	}
+
+	if uuid := i.EventUUID(); uuid != "" {
+		if ok, _ := e.Fields.HasKey("event.id"); !ok {
+			_, _ = e.Fields.Put("event.id", uuid)
+		}
+	}
+
+	if e.Timestamp.IsZero() {
+		if t, err := convertField(i.Item["timestamp"], FieldTypeDate); err == nil {
+			e.Timestamp = t.(time.Time)
+		} else {
+			e.Timestamp = time.Now()
+		}
+	}
+	if len(errs) > 0 {
+		_, _ = e.Fields.Put("error.message", strings.Join(errs, ". "))
+	}
+
+	return e
+}
+
+func convertField(v interface{}, fieldType string) (interface{}, error) {
+	switch fieldType {
+	case FieldTypeAuto:
+		return v, nil
+	case FieldTypeKeyword:
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			b, err := json.Marshal(v)
+			return string(b), err
+		}
+		return fmt.Sprint(v), nil
+	case FieldTypeLong:
+		switch t := v.(type) {
+		case float64:
+			return int64(t), nil
+		case string:
+			return strconv.ParseInt(t, 10, 64)
+		}
+	case FieldTypeDouble:
+		switch t := v.(type) {
+		case float64:
+			return t, nil
+		case string:
+			return strconv.ParseFloat(t, 64)
+		}
+	case FieldTypeBoolean:
+		switch t := v.(type) {
+		case bool:
+			return t, nil
+		case string:
+			return strconv.ParseBool(t)
+		}
+	case FieldTypeDate:
+		switch t := v.(type) {
+		case string:
+			return time.Parse(time.RFC3339Nano, t)
+		case float64:
+			return time.Unix(int64(t), 0).UTC(), nil
+		}
+	case FieldTypeIP:
+		if s, ok := v.(string); ok {
+			if net.ParseIP(s) == nil {
+				return nil, fmt.Errorf("%q is not an IP address", s)
+			}
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("can't convert %v to %s", v, fieldType)
+}
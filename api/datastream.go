@@ -0,0 +1,120 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/beat/events"
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+// DataStreamType is the type of the data streams of the 1Password integration
+// of Elastic Agent.
+const DataStreamType = "logs"
+
+// DataStream returns the name of the data stream of dataset in namespace, such
+// as logs-1password.signin_attempts-default.
+func DataStream(dataset, namespace string) string {
+	return DataStreamType + "-" + dataset + "-" + namespace
+}
+
+// customDataset returns the dataset of a custom stream. Data stream names
+// can't contain dashes other than the separators.
+func customDataset(name string) string {
+	return ECSModule + "." + strings.ReplaceAll(strings.ToLower(name), "-", "_")
+}
+
+// integrationEvent is implemented by the events whose fields are laid out
+// differently by the 1Password integration of Elastic Agent.
+type integrationEvent interface {
+	// integrationFields changes the fields of the ECS document of the event
+	// into the ones of the integration.
+	integrationFields(fields common.MapStr)
+}
+
+// DataStreamEvent maps an event of t to the document the 1Password integration
+// of Elastic Agent would index for it, and routes it to the data stream of t
+// in namespace with @metadata.raw_index.
+func DataStreamEvent(t *EventType, e Event, namespace string) *beat.Event {
+	event := e.BeatEvent()
+	if i, ok := e.(integrationEvent); ok {
+		i.integrationFields(event.Fields)
+	}
+
+	dataset := t.Dataset
+	if dataset == "" {
+		dataset = customDataset(t.Name)
+	}
+
+	event.Fields["data_stream"] = common.MapStr{
+		"type":      DataStreamType,
+		"dataset":   dataset,
+		"namespace": namespace,
+	}
+	if err := setEventDataset(event.Fields, dataset); err != nil {
+		msg := fmt.Sprintf("failed to set event.dataset. %v", err)
+		if previous, _ := event.Fields.GetValue("error.message"); previous != nil {
+			msg = fmt.Sprintf("%v. %s", previous, msg)
+		}
+		_, _ = event.Fields.Put("error.message", msg)
+	}
+	_, _ = event.PutValue("@metadata."+events.FieldMetaRawIndex, DataStream(dataset, namespace))
+	return event
+}
+
+// setEventDataset sets the event.dataset of the fields of an event. The event
+// field set is an ECSEvent for the built-in event types, and a map for custom
+// ones.
+func setEventDataset(fields common.MapStr, dataset string) error {
+	if e, ok := fields["event"].(ECSEvent); ok {
+		e.Dataset = dataset
+		fields["event"] = e
+		return nil
+	}
+	_, err := fields.Put("event.dataset", dataset)
+	return err
+}
+
+// putRelated sets the related field set of an event to the given IP address
+// and users, ignoring empty values.
+func putRelated(fields common.MapStr, ip string, users ...string) {
+	related := common.MapStr{}
+	var names []string
+	for _, u := range users {
+		if u != "" {
+			names = append(names, u)
+		}
+	}
+	if len(names) > 0 {
+		related["user"] = names
+	}
+	if ip != "" {
+		related["ip"] = []string{ip}
+	}
+	if len(related) > 0 {
+		fields["related"] = related
+	}
+}
+
+func (i *SignInAttempt) integrationFields(fields common.MapStr) {
+	_, _ = fields.Put(CustomFieldSet+".category", i.Category)
+	putRelated(fields, i.SignInAttemptClient.IPAddress,
+		i.SignInAttemptTargetUser.UUID, i.SignInAttemptTargetUser.Name, i.SignInAttemptTargetUser.Email)
+}
+
+func (i *ItemUsage) integrationFields(fields common.MapStr) {
+	putRelated(fields, i.ItemUsageClient.IPAddress,
+		i.ItemUsageUser.UUID, i.ItemUsageUser.Name, i.ItemUsageUser.Email)
+}
+
+func (i *AuditEvent) integrationFields(fields common.MapStr) {
+	_, _ = fields.Put(CustomFieldSet+".actor_uuid", i.ActorUUID)
+	_, _ = fields.Put(CustomFieldSet+".session", common.MapStr{
+		"uuid":        i.Session.UUID,
+		"device_uuid": i.Session.DeviceUUID,
+		"login_time":  i.Session.LoginTime,
+		"ip":          i.Session.IP,
+	})
+	putRelated(fields, i.Session.IP, i.ActorUUID)
+}
@@ -3,12 +3,32 @@ package api
 import (
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/ecs/code/go/ecs"
 )
 
 const CustomFieldSet = "onepassword"
 
 var emptyMap = map[string]struct{}{}
 
+// ecsVersion returns the ecs field set of a built-in event.
+func ecsVersion() common.MapStr {
+	return common.MapStr{"version": ecs.Version}
+}
+
+// DocumentID returns the document ID of the event with the given UUID. It is
+// the UUID itself, or the UUID namespaced by account and stream when account
+// is not empty.
+func DocumentID(account, stream, uuid string) string {
+	if account == "" {
+		return uuid
+	}
+	return account + ":" + stream + ":" + uuid
+}
+
+func (i *SignInAttempt) EventUUID() string {
+	return i.UUID
+}
+
 func (i *SignInAttempt) BeatEvent() *beat.Event {
 	var details interface{} = emptyMap
 	if i.Details != nil {
@@ -29,9 +49,8 @@ func (i *SignInAttempt) BeatEvent() *beat.Event {
 	e := &beat.Event{
 		Timestamp: i.Timestamp,
 		Fields: common.MapStr{
-			"event": ECSEvent{
-				Action: i.Category,
-			},
+			"event": ecsEvent(SignInAttemptsDataset, i.UUID, i.Category, categorizeSignInAttempt(i.Category)),
+			"ecs":   ecsVersion(),
 			"user": ECSUser{
 				ID:       i.SignInAttemptTargetUser.UUID,
 				FullName: i.SignInAttemptTargetUser.Name,
@@ -64,6 +83,10 @@ func (i *SignInAttempt) BeatEvent() *beat.Event {
 	return e
 }
 
+func (i *ItemUsage) EventUUID() string {
+	return i.UUID
+}
+
 func (i *ItemUsage) BeatEvent() *beat.Event {
 	var geo *ECSGeo
 	if i.ItemUsageLocation != nil {
@@ -80,9 +103,8 @@ func (i *ItemUsage) BeatEvent() *beat.Event {
 	e := &beat.Event{
 		Timestamp: i.Timestamp,
 		Fields: common.MapStr{
-			"event": ECSEvent{
-				Action: i.Action,
-			},
+			"event": ecsEvent(ItemUsagesDataset, i.UUID, i.Action, categorizeItemUsage(i.Action)),
+			"ecs":   ecsVersion(),
 			"user": ECSUser{
 				ID:       i.ItemUsageUser.UUID,
 				FullName: i.ItemUsageUser.Name,
@@ -114,6 +136,10 @@ func (i *ItemUsage) BeatEvent() *beat.Event {
 	return e
 }
 
+func (i *AuditEvent) EventUUID() string {
+	return i.UUID
+}
+
 func (i *AuditEvent) BeatEvent() *beat.Event {
 	var geo *ECSGeo
 	if i.Location != nil {
@@ -130,9 +156,8 @@ func (i *AuditEvent) BeatEvent() *beat.Event {
 	e := &beat.Event{
 		Timestamp: i.Timestamp,
 		Fields: common.MapStr{
-			"event": ECSEvent{
-				Action: i.Action,
-			},
+			"event": ecsEvent(AuditEventsDataset, i.UUID, i.Action, categorizeAuditEvent(i.Action, i.ObjectType)),
+			"ecs":   ecsVersion(),
 			"user": ECSUser{
 				ID: i.ActorUUID,
 			},
@@ -160,7 +185,15 @@ func (i *AuditEvent) BeatEvent() *beat.Event {
 }
 
 type ECSEvent struct {
-	Action string `json:"action,omitempty" ecs:"action"`
+	ID       string   `json:"id,omitempty" ecs:"id"`
+	Kind     string   `json:"kind,omitempty" ecs:"kind"`
+	Category []string `json:"category,omitempty" ecs:"category"`
+	Type     []string `json:"type,omitempty" ecs:"type"`
+	Outcome  string   `json:"outcome,omitempty" ecs:"outcome"`
+	Action   string   `json:"action,omitempty" ecs:"action"`
+	Provider string   `json:"provider,omitempty" ecs:"provider"`
+	Dataset  string   `json:"dataset,omitempty" ecs:"dataset"`
+	Module   string   `json:"module,omitempty" ecs:"module"`
 }
 
 type ECSUser struct {
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxErrorBody is how much of an error response body is kept on an Error.
+const maxErrorBody = 512
+
+// Error is returned when the Events API responds with a status code other
+// than 200. Use errors.As to inspect it.
+type Error struct {
+	// Endpoint is the path of the request, e.g. /api/v1/auditevents.
+	Endpoint   string
+	StatusCode int
+	Status     string
+	// Message is the error message decoded from the response body, or an
+	// excerpt of the body when it could not be decoded.
+	Message string
+	// RequestID identifies the request in the Events API logs, when the
+	// response carried one.
+	RequestID string
+	// Retryable reports whether the same request may succeed later.
+	Retryable bool
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: unexpected status code: %s", e.Endpoint, e.Status)
+	if e.Message != "" {
+		fmt.Fprintf(&b, ": %s", e.Message)
+	}
+	if e.RequestID != "" {
+		fmt.Fprintf(&b, " (request id %s)", e.RequestID)
+	}
+	return b.String()
+}
+
+// Unauthorized reports whether the token was rejected, either because it is
+// invalid or revoked, or because it lacks access to the endpoint.
+func (e *Error) Unauthorized() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// InvalidCursor reports whether the Events API rejected the cursor of the
+// request, typically because it expired. Sending the same cursor again fails
+// the same way. The Events API has no dedicated error code for it, this is a
+// heuristic matching a 400 whose message mentions the cursor.
+func (e *Error) InvalidCursor() bool {
+	return e.StatusCode == http.StatusBadRequest && strings.Contains(strings.ToLower(e.Message), "cursor")
+}
+
+// newError builds an Error from a non-200 response. It consumes, but does not
+// close, the response body.
+func newError(response *http.Response) *Error {
+	body, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+
+	e := &Error{
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+		Message:    errorMessage(body),
+		RequestID:  firstHeader(response.Header, "X-Request-Id", "X-Trace-Id", "Request-Id", "Traceparent"),
+		Retryable:  isRetryableStatus(response.StatusCode),
+	}
+	if response.Request != nil && response.Request.URL != nil {
+		e.Endpoint = response.Request.URL.Path
+	}
+	return e
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusRequestTimeout ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode >= http.StatusInternalServerError
+}
+
+// errorMessage extracts the message of the JSON error bodies returned by the
+// Events API, such as {"Error":{"Message":"..."}} or {"error":"..."}. Bodies
+// in any other format are returned as is.
+func errorMessage(body []byte) string {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(body, &decoded); err == nil {
+		if message := findMessage(decoded); message != "" {
+			return message
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
+
+func findMessage(m map[string]interface{}) string {
+	for _, key := range []string{"message", "error", "error_description", "detail"} {
+		for k, v := range m {
+			if !strings.EqualFold(k, key) {
+				continue
+			}
+			switch t := v.(type) {
+			case string:
+				return t
+			case map[string]interface{}:
+				if message := findMessage(t); message != "" {
+					return message
+				}
+			}
+		}
+	}
+	return ""
+}
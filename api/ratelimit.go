@@ -0,0 +1,215 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/hashicorp/go-retryablehttp"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter holds back every request made with a token after the Events API
+// asked a request made with the same token to slow down. All streams sharing
+// a token therefore share its rate budget.
+type rateLimiter struct {
+	logger retryablehttp.LeveledLogger
+
+	mu    sync.Mutex
+	until map[string]time.Time
+
+	throttledResponses *monitoring.Uint
+	throttledUntil     *monitoring.Timestamp
+}
+
+func newRateLimiter(logger retryablehttp.LeveledLogger, registry *monitoring.Registry) *rateLimiter {
+	l := &rateLimiter{
+		logger: logger,
+		until:  map[string]time.Time{},
+	}
+	l.throttledResponses = monitoring.NewUint(registry, "throttled_responses")
+	l.throttledUntil = monitoring.NewTimestamp(registry, "throttled_until")
+	monitoring.NewFunc(registry, "throttled_tokens", func(_ monitoring.Mode, v monitoring.Visitor) {
+		v.OnInt(int64(l.throttledTokens()))
+	})
+	return l
+}
+
+// Wait blocks until requests made with the token identified by key may be
+// sent again, or ctx is done.
+func (l *rateLimiter) Wait(ctx context.Context, key string) error {
+	wait := l.delay(key)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Update records the rate limit instructions found in response. It returns
+// how long requests made with the token identified by key are held back.
+func (l *rateLimiter) Update(key string, response *http.Response) time.Duration {
+	wait, ok := throttleDelay(response)
+	if !ok {
+		return 0
+	}
+	if response.StatusCode != http.StatusOK {
+		l.throttledResponses.Inc()
+	}
+	if wait <= 0 {
+		return 0
+	}
+
+	until := time.Now().Add(wait)
+	l.mu.Lock()
+	if until.After(l.until[key]) {
+		l.until[key] = until
+	}
+	l.mu.Unlock()
+	l.throttledUntil.Set(until)
+
+	if l.logger != nil {
+		l.logger.Warn("rate limited by the Events API", "status", response.StatusCode, "wait", wait)
+	}
+	return wait
+}
+
+func (l *rateLimiter) delay(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until, ok := l.until[key]
+	if !ok {
+		return 0
+	}
+	wait := time.Until(until)
+	if wait <= 0 {
+		delete(l.until, key)
+	}
+	return wait
+}
+
+func (l *rateLimiter) throttledTokens() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	now := time.Now()
+	for _, until := range l.until {
+		if until.After(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// throttleDelay returns how long the server asked the client to wait before
+// its next request. The second value is false when the response is not a rate
+// limit instruction.
+//
+// Retry-After is honoured on 429 and 503 responses. The X-RateLimit-Reset (or
+// RateLimit-Reset) header is honoured on any response once the remaining
+// budget is exhausted, its value is either a number of seconds or a Unix time.
+func throttleDelay(response *http.Response) (time.Duration, bool) {
+	if response == nil {
+		return 0, false
+	}
+
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		if wait, ok := parseRetryAfter(response.Header.Get("Retry-After")); ok {
+			return wait, true
+		}
+	}
+
+	if firstHeader(response.Header, "X-RateLimit-Remaining", "RateLimit-Remaining") == "0" {
+		if wait, ok := parseRateLimitReset(firstHeader(response.Header, "X-RateLimit-Reset", "RateLimit-Reset")); ok {
+			return wait, true
+		}
+	}
+
+	return 0, response.StatusCode == http.StatusTooManyRequests
+}
+
+func parseRateLimitReset(header string) (time.Duration, bool) {
+	seconds, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	// Values larger than a year of seconds are Unix times.
+	if seconds > 365*24*60*60 {
+		return time.Until(time.Unix(seconds, 0)), true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// parseRetryAfter parses both forms of the Retry-After header, a number of
+// seconds or an HTTP date.
+func parseRetryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(header, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+func firstHeader(header http.Header, names ...string) string {
+	for _, name := range names {
+		if v := header.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Backoff is a retryablehttp.Backoff that waits exactly as long as the Events
+// API instructed, and falls back to exponential backoff otherwise.
+func (l *rateLimiter) Backoff(min, max time.Duration, attemptNum int, response *http.Response) time.Duration {
+	if wait, ok := throttleDelay(response); ok && wait > 0 {
+		return wait
+	}
+	return retryablehttp.DefaultBackoff(min, max, attemptNum, response)
+}
+
+// throttledTransport makes every request wait for the rate budget of its
+// token, and for the budget of the client if any, and records the rate limit
+// instructions of every response.
+type throttledTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+	budget  *rate.Limiter
+}
+
+func (t *throttledTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	key := request.Header.Get("Authorization")
+	if err := t.limiter.Wait(request.Context(), key); err != nil {
+		return nil, err
+	}
+	if t.budget != nil {
+		if err := t.budget.Wait(request.Context()); err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := t.base.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	t.limiter.Update(key, response)
+	return response, nil
+}
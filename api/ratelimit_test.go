@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+)
+
+func TestThrottleDelay(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		status int
+		header map[string]string
+		// want is the expected delay, up to a second less for the headers
+		// holding a time.
+		want   time.Duration
+		wantOK bool
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "429 without header", status: http.StatusTooManyRequests, wantOK: true},
+		{name: "Retry-After seconds", status: http.StatusTooManyRequests, header: map[string]string{"Retry-After": "30"}, want: 30 * time.Second, wantOK: true},
+		{name: "Retry-After seconds on 503", status: http.StatusServiceUnavailable, header: map[string]string{"Retry-After": "5"}, want: 5 * time.Second, wantOK: true},
+		{
+			name:   "Retry-After HTTP date",
+			status: http.StatusTooManyRequests,
+			header: map[string]string{"Retry-After": now.Add(20 * time.Second).UTC().Format(http.TimeFormat)},
+			want:   20 * time.Second,
+			wantOK: true,
+		},
+		{name: "Retry-After on 200", status: http.StatusOK, header: map[string]string{"Retry-After": "30"}},
+		{name: "negative Retry-After", status: http.StatusTooManyRequests, header: map[string]string{"Retry-After": "-1"}, wantOK: true},
+		{name: "invalid Retry-After", status: http.StatusTooManyRequests, header: map[string]string{"Retry-After": "soon"}, wantOK: true},
+		{
+			name:   "X-RateLimit-Reset seconds",
+			status: http.StatusOK,
+			header: map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "15"},
+			want:   15 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "X-RateLimit-Reset Unix time",
+			status: http.StatusOK,
+			header: map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": strconv.FormatInt(now.Add(time.Minute).Unix(), 10)},
+			want:   time.Minute,
+			wantOK: true,
+		},
+		{
+			name:   "RateLimit-Reset",
+			status: http.StatusOK,
+			header: map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "10"},
+			want:   10 * time.Second,
+			wantOK: true,
+		},
+		{name: "X-RateLimit-Reset with remaining budget", status: http.StatusOK, header: map[string]string{"X-RateLimit-Remaining": "5", "X-RateLimit-Reset": "15"}},
+		{
+			name:   "Retry-After before X-RateLimit-Reset",
+			status: http.StatusTooManyRequests,
+			header: map[string]string{"Retry-After": "3", "X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "15"},
+			want:   3 * time.Second,
+			wantOK: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			for k, v := range tt.header {
+				response.Header.Set(k, v)
+			}
+
+			wait, ok := throttleDelay(response)
+			if ok != tt.wantOK {
+				t.Fatalf("throttleDelay() reports %v, want %v", ok, tt.wantOK)
+			}
+			if wait > tt.want || wait < tt.want-time.Second {
+				t.Errorf("throttleDelay() = %s, want %s", wait, tt.want)
+			}
+		})
+	}
+}
+
+// roundTripperFunc is an http.RoundTripper that calls itself.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestThrottledTransportPerToken(t *testing.T) {
+	// The first request of each token is rate limited for a minute.
+	limited := map[string]bool{}
+	transport := &throttledTransport{
+		base: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			response := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: r}
+			if key := r.Header.Get("Authorization"); !limited[key] {
+				limited[key] = true
+				response.StatusCode = http.StatusTooManyRequests
+				response.Header.Set("Retry-After", "60")
+			}
+			return response, nil
+		}),
+		limiter: newRateLimiter(nil, monitoring.NewRegistry()),
+	}
+
+	send := func(token string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/api/v1/auditevents", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+		_, err = transport.RoundTrip(request)
+		return err
+	}
+
+	if err := send("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("request with the rate limited token returned %v, want it held back", err)
+	}
+	if err := send("b"); err != nil {
+		t.Errorf("request with another token returned %v, want it sent", err)
+	}
+	if err := send("b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("request with the second rate limited token returned %v, want it held back", err)
+	}
+	if n := transport.limiter.throttledTokens(); n != 2 {
+		t.Errorf("throttledTokens() = %d, want 2", n)
+	}
+}
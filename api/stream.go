@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"go.1password.io/eventsapibeat/utils"
+)
+
+// Event is a single item returned by an Events API endpoint. BeatEvent maps
+// the item to its ECS document. EventUUID returns the UUID that identifies the
+// item, or an empty string if it has none.
+type Event interface {
+	BeatEvent() *beat.Event
+	EventUUID() string
+}
+
+// Page is one page of events returned by an Events API endpoint.
+type Page struct {
+	Cursor  string
+	HasMore bool
+	Events  []Event
+	// Raw holds the items of the page as returned by the Events API, in the
+	// order of Events.
+	Raw []json.RawMessage
+}
+
+// EventType describes an Events API endpoint. Registering an EventType is all
+// that is needed for the beat to collect it.
+type EventType struct {
+	// Name identifies the stream. It is used as @metadata.event_type and in the
+	// default cursor state file name.
+	Name string
+	// ConfigKey is the key holding the stream settings in the beat configuration.
+	ConfigKey string
+	// Path of the endpoint, relative to the Events API URL.
+	Path string
+	// FeatureScope is the 1password.com/fts feature the token must carry.
+	FeatureScope string
+	// Dataset is the event.dataset of the events, which also names their data
+	// stream. It is derived from Name when empty.
+	Dataset string
+	// Decode reads a page of events from a response body.
+	Decode func(r io.Reader) (*Page, error)
+}
+
+var (
+	SignInAttemptsEventType = &EventType{
+		Name:         "signinattempts",
+		ConfigKey:    "signin_attempts",
+		Path:         "/api/v1/signinattempts",
+		FeatureScope: utils.SignInAttemptsFeatureScope,
+		Dataset:      SignInAttemptsDataset,
+		Decode:       pageDecoder[SignInAttempt](),
+	}
+	ItemUsagesEventType = &EventType{
+		Name:         "itemusages",
+		ConfigKey:    "item_usages",
+		Path:         "/api/v1/itemusages",
+		FeatureScope: utils.ItemUsageFeatureScope,
+		Dataset:      ItemUsagesDataset,
+		Decode:       pageDecoder[ItemUsage](),
+	}
+	AuditEventsEventType = &EventType{
+		Name:         "auditevents",
+		ConfigKey:    "audit_events",
+		Path:         "/api/v1/auditevents",
+		FeatureScope: utils.AuditEventsFeatureScope,
+		Dataset:      AuditEventsDataset,
+		Decode:       pageDecoder[AuditEvent](),
+	}
+)
+
+var (
+	eventTypesMu sync.RWMutex
+	eventTypes   []*EventType
+)
+
+func init() {
+	for _, t := range []*EventType{SignInAttemptsEventType, ItemUsagesEventType, AuditEventsEventType} {
+		if err := Register(t); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register adds an event type to the set of streams collected by the beat.
+func Register(t *EventType) error {
+	if t.Name == "" || t.ConfigKey == "" || t.Path == "" || t.Decode == nil {
+		return fmt.Errorf("event type %q is incomplete", t.Name)
+	}
+
+	eventTypesMu.Lock()
+	defer eventTypesMu.Unlock()
+	for _, r := range eventTypes {
+		if r.Name == t.Name || r.ConfigKey == t.ConfigKey {
+			return fmt.Errorf("event type %q is already registered", t.Name)
+		}
+	}
+	eventTypes = append(eventTypes, t)
+	return nil
+}
+
+// EventTypes returns the registered event types in registration order.
+func EventTypes() []*EventType {
+	eventTypesMu.RLock()
+	defer eventTypesMu.RUnlock()
+	return append([]*EventType(nil), eventTypes...)
+}
+
+// LookupEventType returns the registered event type with the given name, or
+// nil if there is none.
+func LookupEventType(name string) *EventType {
+	eventTypesMu.RLock()
+	defer eventTypesMu.RUnlock()
+	for _, t := range eventTypes {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// pageDecoder returns a Decode function for endpoints whose items decode into T.
+func pageDecoder[T any, PT interface {
+	*T
+	Event
+}]() func(r io.Reader) (*Page, error) {
+	return func(r io.Reader) (*Page, error) {
+		var response struct {
+			Cursor  string            `json:"cursor"`
+			HasMore bool              `json:"has_more"`
+			Items   []json.RawMessage `json:"items"`
+		}
+		if err := json.NewDecoder(r).Decode(&response); err != nil {
+			return nil, err
+		}
+
+		page := &Page{
+			Cursor:  response.Cursor,
+			HasMore: response.HasMore,
+			Events:  make([]Event, len(response.Items)),
+			Raw:     response.Items,
+		}
+		items := make([]T, len(response.Items))
+		for i, raw := range response.Items {
+			if err := json.Unmarshal(raw, &items[i]); err != nil {
+				return nil, err
+			}
+			page.Events[i] = PT(&items[i])
+		}
+		return page, nil
+	}
+}
@@ -0,0 +1,589 @@
+package beater
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/acker"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"go.1password.io/eventsapibeat/config"
+	"go.1password.io/eventsapibeat/store"
+)
+
+const (
+	// backfillPlanSuffix is appended to the state file of a backfill to name
+	// the file of its plan.
+	backfillPlanSuffix = ".plan"
+	// backfillProgressInterval is how often the progress of a backfill is
+	// logged.
+	backfillProgressInterval = 30 * time.Second
+)
+
+// BackfillOptions selects the events re-ingested by the backfill command.
+type BackfillOptions struct {
+	// Stream is the name or configuration key of the stream, e.g. auditevents
+	// or audit_events.
+	Stream string
+	// From and To are the --from and --to flags, as parsed by ParseTimeRange.
+	// They are resolved when the backfill starts, and the resolved range is
+	// saved in its plan to resume from.
+	From string
+	To   string
+	// StateFile is the temporary cursor file of the backfill. It is derived
+	// from the cursor_state_file of the stream and the From and To flags when
+	// empty, so that an interrupted backfill resumes when the same command is
+	// run again. Every slice gets its own file, suffixed with its number, when
+	// there is more than one.
+	StateFile string
+	// Slices is the number of equal time slices the range is split into, each
+	// fetched with its own cursor. It defaults to 1, and must not change when
+	// the backfill is resumed, its slices are saved in its plan.
+	Slices int
+	// Concurrency is the number of slices fetched at once. It defaults to
+	// Slices.
+	Concurrency int
+	// RequestsPerSecond caps the requests sent by all slices together. Zero
+	// means no limit.
+	RequestsPerSecond float64
+}
+
+// ParseTimeRange parses the --from and --to flags of the backfill and fetch
+// commands. Both take the values of start_from, except earliest.
+func ParseTimeRange(from, to string, now time.Time) (time.Time, time.Time, error) {
+	fromTime, err := parseRangeTime("from", from, now)
+	if err != nil {
+		return fromTime, fromTime, err
+	}
+	toTime, err := parseRangeTime("to", to, now)
+	if err != nil {
+		return fromTime, toTime, err
+	}
+	if !toTime.After(fromTime) {
+		return fromTime, toTime, fmt.Errorf("--to must be after --from")
+	}
+	return fromTime, toTime, nil
+}
+
+func parseRangeTime(flag, v string, now time.Time) (time.Time, error) {
+	if v == "" || v == config.StartFromEarliest {
+		return time.Time{}, fmt.Errorf("--%s must be now, a duration or an RFC 3339 time", flag)
+	}
+	t, err := config.ResolveStartFrom(v, now)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --%s. %w", flag, err)
+	}
+	return *t, nil
+}
+
+// stateFileKey turns the value of a --from or --to flag into a part of a file
+// name.
+func stateFileKey(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, v)
+}
+
+// backfillPlan is saved next to the cursor files of a backfill when it
+// starts, so that a resumed backfill covers the same range, split into the
+// same slices, even when its flags are relative to the current time.
+type backfillPlan struct {
+	Stream string `json:"stream"`
+	// FromFlag and ToFlag are the --from and --to flags the range was
+	// resolved from.
+	FromFlag string              `json:"from_flag"`
+	ToFlag   string              `json:"to_flag"`
+	From     time.Time           `json:"from"`
+	To       time.Time           `json:"to"`
+	Slices   []backfillPlanSlice `json:"slices"`
+}
+
+// backfillPlanSlice is the range of a slice of a backfill, the events of
+// its saved cursor are bounded by it.
+type backfillPlanSlice struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// loadBackfillPlan returns the saved plan of the backfill, or resolves and
+// saves a new one.
+func loadBackfillPlan(options BackfillOptions, now time.Time) (backfillPlan, error) {
+	name := options.StateFile + backfillPlanSuffix
+	plan := backfillPlan{Stream: options.Stream, FromFlag: options.From, ToFlag: options.To}
+
+	data, err := os.ReadFile(name)
+	if err == nil {
+		var saved backfillPlan
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return plan, fmt.Errorf("invalid backfill plan %s. %w", name, err)
+		}
+		if saved.Stream != plan.Stream || saved.FromFlag != plan.FromFlag || saved.ToFlag != plan.ToFlag {
+			return plan, fmt.Errorf("%s is the plan of the backfill of %s from %s to %s, run it with the same flags or remove "+
+				"its state files", name, saved.Stream, saved.FromFlag, saved.ToFlag)
+		}
+		if len(saved.Slices) != options.Slices {
+			return plan, fmt.Errorf("%s is the plan of a backfill split into %d slices, run it with --slices %d or remove "+
+				"its state files", name, len(saved.Slices), len(saved.Slices))
+		}
+		return saved, nil
+	}
+	if !os.IsNotExist(err) {
+		return plan, fmt.Errorf("failed to read backfill plan. %w", err)
+	}
+
+	if plan.From, plan.To, err = ParseTimeRange(options.From, options.To, now); err != nil {
+		return plan, err
+	}
+	if plan.Slices, err = splitRange(plan.From, plan.To, options.Slices); err != nil {
+		return plan, err
+	}
+	if data, err = json.MarshalIndent(plan, "", "  "); err == nil {
+		err = store.WriteFile(name, append(data, '\n'))
+	}
+	if err != nil {
+		return plan, fmt.Errorf("failed to save backfill plan. %w", err)
+	}
+	return plan, nil
+}
+
+// BackfillSliceSummary reports what a single slice of a backfill did.
+type BackfillSliceSummary struct {
+	From         time.Time
+	To           time.Time
+	Published    int64
+	Acknowledged int64
+	// Progress is the part of the time range of the slice, from 0 to 1,
+	// covered by the published events.
+	Progress float64
+	Complete bool
+	Err      error
+}
+
+// BackfillSummary reports what a backfill did.
+type BackfillSummary struct {
+	Stream       string
+	From         time.Time
+	To           time.Time
+	StateFile    string
+	Published    int64
+	Acknowledged int64
+	// Complete is true once every event of the range has been acknowledged.
+	// The temporary cursor files are removed then.
+	Complete bool
+	Slices   []BackfillSliceSummary
+}
+
+func (s BackfillSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Backfill of %s from %s to %s: ", s.Stream, s.From.Format(time.RFC3339), s.To.Format(time.RFC3339))
+	fmt.Fprintf(&b, "%d events published, %d acknowledged", s.Published, s.Acknowledged)
+	if s.Complete {
+		b.WriteString(", complete")
+	} else if s.StateFile != "" {
+		fmt.Fprintf(&b, ", interrupted, run the same command again to resume from %s", s.StateFile)
+	}
+
+	if len(s.Slices) > 1 {
+		for i, slice := range s.Slices {
+			fmt.Fprintf(&b, "\n  slice %d/%d ", i+1, len(s.Slices))
+			b.WriteString(slice.String())
+		}
+	}
+	return b.String()
+}
+
+func (s BackfillSliceSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "from %s to %s: ", s.From.Format(time.RFC3339), s.To.Format(time.RFC3339))
+	fmt.Fprintf(&b, "%d events published, %d acknowledged, %.0f%% done", s.Published, s.Acknowledged, s.Progress*100)
+	switch {
+	case s.Complete:
+		b.WriteString(", complete")
+	case s.Err != nil:
+		fmt.Fprintf(&b, ", failed: %v", s.Err)
+	}
+	return b.String()
+}
+
+// Backfill is a beater that publishes the events of a single stream in a
+// bounded time range, then stops. It never touches the cursor of the stream,
+// its progress is kept in temporary cursor files instead.
+//
+// The range is split into slices, each one fetched with its own reset cursor
+// bounded by start_time and end_time, and checkpointed in its own file.
+type Backfill struct {
+	options BackfillOptions
+	plan    backfillPlan
+	log     *logp.Logger
+
+	ctx        context.Context
+	cancel     context.CancelFunc
+	beatClient beat.Client
+	slices     []*backfillSlice
+	// sliceOf finds the slice of an event from the tracker of its page.
+	sliceOf map[*cursorTracker]*backfillSlice
+
+	mu sync.Mutex
+}
+
+// backfillSlice is the part of a backfill between from and to.
+type backfillSlice struct {
+	from      time.Time
+	to        time.Time
+	stateFile string
+	stream    *stream
+
+	published    int64
+	acknowledged int64
+	// latest is the time of the newest published event, in Unix nanoseconds.
+	latest int64
+
+	// fetched, complete and err are guarded by Backfill.mu.
+	fetched  bool
+	complete bool
+	err      error
+}
+
+// NewBackfill returns a backfill whose Create method is the beat.Creator of
+// the backfill command. Summary is meaningful once the beat has run.
+func NewBackfill(options BackfillOptions) *Backfill {
+	return &Backfill{
+		options: options,
+		log:     logp.NewLogger(BeatName),
+	}
+}
+
+// Create is a beat.Creator.
+func (b *Backfill) Create(_ *beat.Beat, cfg *common.Config) (beat.Beater, error) {
+	if b.options.Slices == 0 {
+		b.options.Slices = 1
+	}
+	if b.options.Concurrency == 0 {
+		b.options.Concurrency = b.options.Slices
+	}
+	if b.options.Slices < 0 || b.options.Concurrency < 0 || b.options.RequestsPerSecond < 0 {
+		return nil, fmt.Errorf("slices, concurrency and requests per second can't be negative")
+	}
+
+	c, err := loadConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sc, err := findStreamConfig(cfg, c, b.options.Stream)
+	if err != nil {
+		return nil, err
+	}
+	b.options.Stream = sc.eventType.Name
+
+	if b.options.StateFile == "" {
+		b.options.StateFile = fmt.Sprintf("%s.backfill-%s-%s", sc.config.CursorStateFile,
+			stateFileKey(b.options.From), stateFileKey(b.options.To))
+	}
+
+	b.plan, err = loadBackfillPlan(b.options, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	b.slices = newBackfillSlices(b.options.StateFile, b.plan)
+
+	client, err := newAPIClient(c, b.options.RequestsPerSecond, b.log)
+	if err != nil {
+		return nil, err
+	}
+
+	b.sliceOf = map[*cursorTracker]*backfillSlice{}
+	for _, s := range b.slices {
+		eventConfig := sc.config
+		eventConfig.StartingCursor = ""
+		eventConfig.StartTime = ""
+		eventConfig.StartFrom = s.from.Format(time.RFC3339)
+		eventConfig.EndTime = s.to.Format(time.RFC3339)
+		if _, err := eventConfig.Cursor(time.Now()); err != nil {
+			b.closeCursorStores()
+			return nil, fmt.Errorf("invalid backfill range. %w", err)
+		}
+
+		cursorStore, err := store.NewCursorHistoryFileStore(s.stateFile)
+		if err != nil {
+			b.closeCursorStores()
+			return nil, fmt.Errorf("failed to open backfill cursor file. %w", err)
+		}
+		s.stream = newStream(sc.eventType, eventConfig, client, cursorStore, b.log)
+		s.stream.documentID = c.DocumentID
+		s.stream.dataStream = c.DataStream
+		s.stream.onInvalidCursor = c.OnInvalidCursor
+		b.sliceOf[s.stream.cursors] = s
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	return b, nil
+}
+
+// splitRange splits the range of a backfill into n slices of equal length,
+// on whole seconds.
+func splitRange(from, to time.Time, n int) ([]backfillPlanSlice, error) {
+	step := to.Sub(from) / time.Duration(n)
+	if step < time.Second {
+		return nil, fmt.Errorf("a %s range can't be split into %d slices", to.Sub(from), n)
+	}
+
+	slices := make([]backfillPlanSlice, n)
+	for i := range slices {
+		slices[i].From = from
+		slices[i].To = to
+		if i < n-1 {
+			slices[i].To = slices[0].From.Add(step * time.Duration(i+1)).Truncate(time.Second)
+		}
+		from = slices[i].To
+	}
+	return slices, nil
+}
+
+// newBackfillSlices returns the slices of plan, whose cursors are kept in
+// stateFile, suffixed with their number when there is more than one.
+func newBackfillSlices(stateFile string, plan backfillPlan) []*backfillSlice {
+	n := len(plan.Slices)
+	slices := make([]*backfillSlice, n)
+	for i, p := range plan.Slices {
+		name := stateFile
+		if n > 1 {
+			name = fmt.Sprintf("%s.%d-of-%d", stateFile, i+1, n)
+		}
+		slices[i] = &backfillSlice{from: p.From, to: p.To, stateFile: name}
+	}
+	return slices
+}
+
+func (b *Backfill) Run(bt *beat.Beat) error {
+	defer b.closeCursorStores()
+
+	var err error
+	b.beatClient, err = bt.Publisher.ConnectWith(beat.ClientConfig{
+		PublishMode: beat.GuaranteedSend,
+		ACKHandler: acker.ConnectionOnly(acker.EventPrivateReporter(func(acked int, data []interface{}) {
+			for _, d := range data {
+				if p, ok := d.(*cursorPage); ok {
+					if s := b.sliceOf[p.tracker]; s != nil {
+						atomic.AddInt64(&s.acknowledged, 1)
+					}
+				}
+			}
+			ackCursorPages(acked, data)
+		})),
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := b.beatClient.Close(); err != nil {
+			b.log.Error(err)
+		}
+	}()
+
+	// Every slice uses the same token.
+	if err := b.slices[0].stream.verifyToken(b.ctx, b.log); err != nil {
+		return err
+	}
+
+	for i, s := range b.slices {
+		if saved, err := s.stream.cursorStore.GetValue(); err == nil && saved != "" {
+			b.log.Infof("Resuming %s backfill slice %d/%d from %s", b.options.Stream, i+1, len(b.slices), s.stateFile)
+		}
+	}
+
+	eventsChan := make(chan *beat.Event)
+	fetched := make(chan struct{})
+	go func() {
+		b.fetchSlices(eventsChan)
+		close(fetched)
+	}()
+
+	ticker := time.NewTicker(backfillProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev := <-eventsChan:
+			b.beatClient.Publish(*ev)
+			if p, ok := ev.Private.(*cursorPage); ok {
+				if s := b.sliceOf[p.tracker]; s != nil {
+					atomic.AddInt64(&s.published, 1)
+					atomic.StoreInt64(&s.latest, ev.Timestamp.UnixNano())
+				}
+			}
+		case <-ticker.C:
+			b.logProgress()
+		case <-fetched:
+			if b.ctx.Err() != nil {
+				return nil
+			}
+			return b.waitForACKs()
+		}
+	}
+}
+
+// fetchSlices fetches every slice, at most Concurrency at once, sending their
+// events to c. A failed slice does not stop the other ones.
+func (b *Backfill) fetchSlices(c chan<- *beat.Event) {
+	sem := make(chan struct{}, b.options.Concurrency)
+	var wg sync.WaitGroup
+	for i, s := range b.slices {
+		wg.Add(1)
+		go func(i int, s *backfillSlice) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-b.ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			cursor, err := s.stream.startingCursor()
+			if err == nil {
+				cursor, err = s.stream.poll(b.ctx, cursor, c)
+			}
+			if err != nil && isInvalidCursor(err) && cursor.IsContinuation() {
+				if cursor, err = s.stream.recoverCursor(err); err == nil {
+					_, err = s.stream.poll(b.ctx, cursor, c)
+				}
+			}
+
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			switch {
+			case err == nil:
+				s.fetched = true
+			case !errors.Is(err, context.Canceled):
+				b.log.Errorf("Backfill of %s slice %d/%d failed: %v", b.options.Stream, i+1, len(b.slices), err)
+				s.err = err
+			}
+		}(i, s)
+	}
+	wg.Wait()
+}
+
+// waitForACKs waits until every published event has been acknowledged, then
+// removes the temporary cursor files if every slice is complete.
+func (b *Backfill) waitForACKs() error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for b.pending() > 0 {
+		select {
+		case <-b.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+
+	failed := 0
+	b.mu.Lock()
+	for _, s := range b.slices {
+		s.stream.cursors.Flush()
+		if err := s.stream.cursors.Err(); err != nil && s.err == nil {
+			s.err = err
+		}
+		s.complete = s.fetched && s.err == nil
+		if !s.complete {
+			failed++
+		}
+	}
+	b.mu.Unlock()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d %s backfill slices failed", failed, len(b.slices), b.options.Stream)
+	}
+
+	b.closeCursorStores()
+	for _, s := range b.slices {
+		if err := os.Remove(s.stateFile); err != nil && !os.IsNotExist(err) {
+			b.log.Warnf("Failed to remove backfill cursor file %s: %v", s.stateFile, err)
+		}
+	}
+	if err := os.Remove(b.options.StateFile + backfillPlanSuffix); err != nil && !os.IsNotExist(err) {
+		b.log.Warnf("Failed to remove backfill plan %s: %v", b.options.StateFile+backfillPlanSuffix, err)
+	}
+	return nil
+}
+
+func (b *Backfill) pending() int {
+	n := 0
+	for _, s := range b.slices {
+		n += s.stream.cursors.Pending()
+	}
+	return n
+}
+
+func (b *Backfill) logProgress() {
+	for i, s := range b.Summary().Slices {
+		b.log.Infof("Backfill of %s slice %d/%d %s", b.options.Stream, i+1, len(b.slices), s)
+	}
+}
+
+func (b *Backfill) Stop() {
+	b.cancel()
+}
+
+func (b *Backfill) closeCursorStores() {
+	for _, s := range b.slices {
+		if s.stream == nil || s.stream.cursorStore == nil {
+			continue
+		}
+		s.stream.cursors.Close()
+		if err := s.stream.cursorStore.Close(); err != nil {
+			b.log.Errorf("failed to close backfill cursor file %s: %v", s.stateFile, err)
+		}
+		s.stream.cursorStore = nil
+	}
+}
+
+// Summary returns what the backfill did, or has done so far.
+func (b *Backfill) Summary() BackfillSummary {
+	summary := BackfillSummary{
+		Stream:    b.options.Stream,
+		From:      b.plan.From,
+		To:        b.plan.To,
+		StateFile: b.options.StateFile,
+		Complete:  len(b.slices) > 0,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.slices {
+		slice := BackfillSliceSummary{
+			From:         s.from,
+			To:           s.to,
+			Published:    atomic.LoadInt64(&s.published),
+			Acknowledged: atomic.LoadInt64(&s.acknowledged),
+			Complete:     s.complete,
+			Err:          s.err,
+		}
+		if latest := atomic.LoadInt64(&s.latest); s.complete {
+			slice.Progress = 1
+		} else if latest > 0 {
+			slice.Progress = float64(latest-s.from.UnixNano()) / float64(s.to.Sub(s.from))
+			if slice.Progress < 0 {
+				slice.Progress = 0
+			} else if slice.Progress > 1 {
+				slice.Progress = 1
+			}
+		}
+
+		summary.Published += slice.Published
+		summary.Acknowledged += slice.Acknowledged
+		summary.Complete = summary.Complete && slice.Complete
+		summary.Slices = append(summary.Slices, slice)
+	}
+	return summary
+}
@@ -0,0 +1,100 @@
+package beater
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadBackfillPlan(t *testing.T) {
+	options := BackfillOptions{
+		Stream:    "auditevents",
+		From:      "7d",
+		To:        "now",
+		StateFile: filepath.Join(t.TempDir(), "auditevents.backfill"),
+		Slices:    3,
+	}
+	started := testStart.Add(7 * 24 * time.Hour)
+
+	plan, err := loadBackfillPlan(options, started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.From.Equal(testStart) || !plan.To.Equal(started) {
+		t.Fatalf("planned range %s to %s, want %s to %s", plan.From, plan.To, testStart, started)
+	}
+
+	// Resuming the next day covers the same range.
+	resumed, err := loadBackfillPlan(options, started.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed.From.Equal(plan.From) || !resumed.To.Equal(plan.To) {
+		t.Errorf("resumed range %s to %s, want %s to %s", resumed.From, resumed.To, plan.From, plan.To)
+	}
+	if len(resumed.Slices) != len(plan.Slices) {
+		t.Fatalf("resumed %d slices, want %d", len(resumed.Slices), len(plan.Slices))
+	}
+	for i, slice := range resumed.Slices {
+		if !slice.From.Equal(plan.Slices[i].From) || !slice.To.Equal(plan.Slices[i].To) {
+			t.Errorf("resumed slice %d from %s to %s, want %s to %s", i+1, slice.From, slice.To, plan.Slices[i].From, plan.Slices[i].To)
+		}
+	}
+
+	resliced := options
+	resliced.Slices = 4
+	if _, err := loadBackfillPlan(resliced, started); err == nil {
+		t.Error("loadBackfillPlan resumed the plan with other slices")
+	}
+
+	other := options
+	other.From = "30d"
+	if _, err := loadBackfillPlan(other, started); err == nil {
+		t.Error("loadBackfillPlan resumed the plan of other flags")
+	}
+}
+
+func TestSplitRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		to      time.Time
+		n       int
+		want    []time.Time
+		wantErr bool
+	}{
+		{name: "single slice", to: testStart.Add(time.Hour), n: 1, want: []time.Time{testStart, testStart.Add(time.Hour)}},
+		{
+			name: "equal slices",
+			to:   testStart.Add(3 * time.Hour),
+			n:    3,
+			want: []time.Time{testStart, testStart.Add(time.Hour), testStart.Add(2 * time.Hour), testStart.Add(3 * time.Hour)},
+		},
+		{
+			name: "whole seconds",
+			to:   testStart.Add(10 * time.Second),
+			n:    3,
+			want: []time.Time{testStart, testStart.Add(3 * time.Second), testStart.Add(6 * time.Second), testStart.Add(10 * time.Second)},
+		},
+		{name: "slices shorter than a second", to: testStart.Add(2 * time.Second), n: 3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slices, err := splitRange(testStart, tt.to, tt.n)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitRange returned %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(slices) != tt.n {
+				t.Fatalf("splitRange returned %d slices, want %d", len(slices), tt.n)
+			}
+			for i, slice := range slices {
+				if !slice.From.Equal(tt.want[i]) || !slice.To.Equal(tt.want[i+1]) {
+					t.Errorf("slice %d is %s to %s, want %s to %s", i+1, slice.From, slice.To, tt.want[i], tt.want[i+1])
+				}
+			}
+		})
+	}
+}
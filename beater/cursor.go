@@ -0,0 +1,188 @@
+package beater
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"go.1password.io/eventsapibeat/store"
+)
+
+// cursorTracker persists the cursors of a single stream. A cursor is only
+// written to the store once every event of the page that produced it, and of
+// all earlier pages, has been acknowledged by the publisher pipeline.
+//
+// Cursors are written in the background, so that the ACK handler never waits
+// for the store. Only the latest committed cursor is written, the ones
+// committed while a write is in progress are skipped.
+type cursorTracker struct {
+	name  string
+	store store.CursorStore
+	log   *logp.Logger
+	// dedup, when not nil, records the UUIDs of the acknowledged events.
+	dedup *dedupFilter
+
+	mu    sync.Mutex
+	pages []*cursorPage
+	err   error
+	// committed is the latest committed cursor, and unwritten whether it
+	// still has to be written to the store.
+	committed string
+	unwritten bool
+	closed    bool
+	wake      chan struct{}
+	done      chan struct{}
+	writeMu   sync.Mutex
+}
+
+// cursorPage is attached to every event of a page as beat.Event.Private, so
+// that the ACK handler can find its way back to the tracker.
+type cursorPage struct {
+	tracker *cursorTracker
+	cursor  string
+	pending int
+	// uuids are the UUIDs of the events of the page in publishing order,
+	// which is also the order in which they are acknowledged.
+	uuids []string
+	acked int
+}
+
+func newCursorTracker(name string, s store.CursorStore, log *logp.Logger) *cursorTracker {
+	t := &cursorTracker{
+		name:  name,
+		store: s,
+		log:   log,
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	go t.writeCommitted()
+	return t
+}
+
+// AddPage registers a page of events, whose UUIDs are uuids, and whose
+// continuation cursor is cursor. It must be called before any of the page's
+// events are published.
+func (t *cursorTracker) AddPage(cursor string, uuids []string) *cursorPage {
+	p := &cursorPage{
+		tracker: t,
+		cursor:  cursor,
+		pending: len(uuids),
+		uuids:   uuids,
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pages = append(t.pages, p)
+	if len(uuids) == 0 {
+		t.commit()
+	}
+	return p
+}
+
+// Err returns, and clears, the last error encountered when persisting a
+// cursor. Call Flush first to get the error of the latest committed cursor.
+func (t *cursorTracker) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.err
+	t.err = nil
+	return err
+}
+
+// Pending returns the number of published events that have not been
+// acknowledged yet.
+func (t *cursorTracker) Pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, p := range t.pages {
+		n += p.pending
+	}
+	return n
+}
+
+func (t *cursorTracker) ack(p *cursorPage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dedup != nil && p.acked < len(p.uuids) && p.uuids[p.acked] != "" {
+		t.dedup.record(p.uuids[p.acked])
+	}
+	p.acked++
+	p.pending--
+	t.commit()
+}
+
+// commit writes the cursor of the newest fully acknowledged page, provided all
+// pages before it were fully acknowledged too. t.mu must be held.
+func (t *cursorTracker) commit() {
+	i := 0
+	for i < len(t.pages) && t.pages[i].pending <= 0 {
+		i++
+	}
+	if i == 0 {
+		return
+	}
+
+	t.committed, t.unwritten = t.pages[i-1].cursor, true
+	t.pages = t.pages[i:]
+	if !t.closed {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// writeCommitted writes the committed cursors until the tracker is closed.
+func (t *cursorTracker) writeCommitted() {
+	defer close(t.done)
+	for range t.wake {
+		t.Flush()
+	}
+}
+
+// Flush writes the latest committed cursor to the store, unless it was
+// written already, and waits for writes in progress.
+func (t *cursorTracker) Flush() {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	t.mu.Lock()
+	cursor, unwritten := t.committed, t.unwritten
+	t.unwritten = false
+	t.mu.Unlock()
+	if !unwritten {
+		return
+	}
+
+	if err := t.store.SetValue(cursor); err != nil {
+		t.log.Errorf("failed to set %s cursor: %v", t.name, err)
+		t.mu.Lock()
+		t.err = fmt.Errorf("failed to set %s cursor. %w", t.name, err)
+		t.mu.Unlock()
+	}
+}
+
+// Close stops the background writer and writes the latest committed cursor.
+// Cursors committed afterwards are only written by Flush.
+func (t *cursorTracker) Close() {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.wake)
+	}
+	t.mu.Unlock()
+
+	<-t.done
+	t.Flush()
+}
+
+// ackCursorPages is the publisher ACK callback. It receives the private data of
+// every acknowledged (or dropped) event in publishing order.
+func ackCursorPages(_ int, data []interface{}) {
+	for _, d := range data {
+		if p, ok := d.(*cursorPage); ok {
+			p.tracker.ack(p)
+		}
+	}
+}
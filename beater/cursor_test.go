@@ -0,0 +1,68 @@
+package beater
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// blockingStore is a cursor store whose writes wait until release is closed.
+type blockingStore struct {
+	release chan struct{}
+
+	mu     sync.Mutex
+	values []string
+}
+
+func (s *blockingStore) GetValue() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.values) == 0 {
+		return "", nil
+	}
+	return s.values[len(s.values)-1], nil
+}
+
+func (s *blockingStore) SetValue(v string) error {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = append(s.values, v)
+	return nil
+}
+
+func (s *blockingStore) Close() error {
+	return nil
+}
+
+func TestCursorTrackerWritesInBackground(t *testing.T) {
+	cursorStore := &blockingStore{release: make(chan struct{})}
+	tracker := newCursorTracker("auditevents", cursorStore, logp.NewLogger("test"))
+
+	acked := make(chan struct{})
+	go func() {
+		defer close(acked)
+		for _, cursor := range []string{"1", "2", "3"} {
+			p := tracker.AddPage(cursor, []string{"uuid"})
+			ackCursorPages(1, []interface{}{p})
+		}
+	}()
+	select {
+	case <-acked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("acknowledging events waited for the cursor store")
+	}
+
+	close(cursorStore.release)
+	tracker.Close()
+	if saved, _ := cursorStore.GetValue(); saved != "3" {
+		t.Errorf("saved cursor %q, want %q", saved, "3")
+	}
+	// The first write may have started before the other pages were
+	// committed, the later ones are coalesced.
+	if n := len(cursorStore.values); n > 2 {
+		t.Errorf("cursor store received %d writes, want at most 2", n)
+	}
+}
@@ -0,0 +1,255 @@
+package beater
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"go.1password.io/eventsapibeat/api"
+	"go.1password.io/eventsapibeat/config"
+	"go.1password.io/eventsapibeat/store"
+)
+
+// CursorCommand implements the cursor subcommands, which inspect and change
+// the cursor_state_file of the configured streams. Changes are appended to the
+// file, so that they show up in its history, and are refused while another
+// process, such as the beat, holds the file.
+type CursorCommand struct {
+	streams []streamConfig
+	out     io.Writer
+}
+
+// NewCursorCommand reads the streams of cfg, the beat configuration, and
+// writes its output to out.
+func NewCursorCommand(cfg *common.Config, out io.Writer) (*CursorCommand, error) {
+	c, err := loadConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if c.CursorStore.Type != config.CursorStoreFile {
+		return nil, fmt.Errorf("the cursor commands only support the %s cursor store", config.CursorStoreFile)
+	}
+
+	streams, err := loadStreamConfigs(cfg, c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config. %v", err)
+	}
+	return &CursorCommand{streams: streams, out: out}, nil
+}
+
+// List prints the current cursor of every stream.
+func (c *CursorCommand) List() error {
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STREAM\tENABLED\tFILE\tSAVED AT\tCURSOR")
+	for _, sc := range c.streams {
+		saved, cursor := "-", "no cursor saved"
+		records, err := store.ReadHistory(sc.config.CursorStateFile)
+		switch {
+		case err != nil && !errors.Is(err, os.ErrNotExist):
+			cursor = err.Error()
+		case len(records) > 0:
+			last := records[len(records)-1]
+			saved, cursor = formatRecordTime(last.Time), describeCursor(last.Value)
+		}
+		if owner, held := store.Holder(sc.config.CursorStateFile); held {
+			cursor += fmt.Sprintf(" (in use by %s)", owner)
+		}
+		fmt.Fprintf(w, "%s\t%t\t%s\t%s\t%s\n", sc.eventType.Name, sc.config.Enabled, sc.config.CursorStateFile, saved, cursor)
+	}
+	return w.Flush()
+}
+
+// Show prints the current cursor of a stream.
+func (c *CursorCommand) Show(stream string) error {
+	sc, records, err := c.history(stream)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		fmt.Fprintf(c.out, "No %s cursor saved in %s\n", sc.eventType.Name, sc.config.CursorStateFile)
+		return nil
+	}
+
+	last := records[len(records)-1]
+	fmt.Fprintf(c.out, "Stream:   %s\n", sc.eventType.Name)
+	fmt.Fprintf(c.out, "File:     %s\n", sc.config.CursorStateFile)
+	fmt.Fprintf(c.out, "Saved at: %s\n", formatRecordTime(last.Time))
+	fmt.Fprintf(c.out, "Cursor:   %s\n", last.Value)
+	if owner, held := store.Holder(sc.config.CursorStateFile); held {
+		fmt.Fprintf(c.out, "In use by %s\n", owner)
+	}
+	return nil
+}
+
+// History prints the last n cursors of a stream, or all of them when n is 0,
+// oldest first. The current cursor is step 0, the one before it step 1, and
+// so on.
+func (c *CursorCommand) History(stream string, n int) error {
+	_, records, err := c.history(stream)
+	if err != nil {
+		return err
+	}
+
+	first := 0
+	if n > 0 && n < len(records) {
+		first = len(records) - n
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tSAVED AT\tCURSOR")
+	for i := first; i < len(records); i++ {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", len(records)-1-i, formatRecordTime(records[i].Time), records[i].Value)
+	}
+	return w.Flush()
+}
+
+// Rewind makes the cursor saved steps saves before the current one current
+// again. When before, a duration before now or an RFC 3339 time, is not
+// empty, the newest cursor saved before it is used instead.
+func (c *CursorCommand) Rewind(stream string, steps int, before string, now time.Time) error {
+	sc, records, err := c.history(stream)
+	if err != nil {
+		return err
+	}
+
+	i := -1
+	if before == "" {
+		if steps <= 0 {
+			return fmt.Errorf("steps must be greater than 0")
+		}
+		if steps < len(records) {
+			i = len(records) - 1 - steps
+		}
+	} else {
+		beforeTime, err := parseRangeTime("before", before, now)
+		if err != nil {
+			return err
+		}
+		for j := len(records) - 1; j >= 0; j-- {
+			if !records[j].Time.IsZero() && records[j].Time.Before(beforeTime) {
+				i = j
+				break
+			}
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("no earlier %s cursor to rewind to", sc.eventType.Name)
+	}
+
+	return c.save(sc, records[i].Value)
+}
+
+// Reset makes the next run of a stream start from startFrom, which takes the
+// values of the start_from setting. The configured start is used when it is
+// empty.
+func (c *CursorCommand) Reset(stream string, startFrom string, now time.Time) error {
+	sc, err := c.stream(stream)
+	if err != nil {
+		return err
+	}
+
+	eventConfig := sc.config
+	if startFrom != "" {
+		eventConfig.StartingCursor = ""
+		eventConfig.StartTime = ""
+		eventConfig.StartFrom = startFrom
+	}
+	cursor, err := eventConfig.Cursor(now)
+	if err != nil {
+		return err
+	}
+	encoded, err := cursor.Encode()
+	if err != nil {
+		return err
+	}
+	return c.save(sc, encoded)
+}
+
+// Set saves cursor, the JSON form of a reset or continuation cursor, as the
+// current cursor of a stream.
+func (c *CursorCommand) Set(stream string, cursor string) error {
+	sc, err := c.stream(stream)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := api.ParseCursor(cursor)
+	if err != nil {
+		return err
+	}
+	encoded, err := parsed.Encode()
+	if err != nil {
+		return err
+	}
+	return c.save(sc, encoded)
+}
+
+func (c *CursorCommand) stream(name string) (*streamConfig, error) {
+	for i := range c.streams {
+		sc := &c.streams[i]
+		if sc.eventType.Name == name || sc.eventType.ConfigKey == name {
+			return sc, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown stream %s", name)
+}
+
+func (c *CursorCommand) history(name string) (*streamConfig, []store.Record, error) {
+	sc, err := c.stream(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, err := store.ReadHistory(sc.config.CursorStateFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	return sc, records, nil
+}
+
+// save appends value to the cursor file of a stream. It fails when the file is
+// in use by another process.
+func (c *CursorCommand) save(sc *streamConfig, value string) error {
+	cursorStore, err := store.NewCursorHistoryFileStore(sc.config.CursorStateFile)
+	if err != nil {
+		var locked *store.LockedError
+		if errors.As(err, &locked) {
+			return fmt.Errorf("%s, stop it before changing the %s cursor", locked, sc.eventType.Name)
+		}
+		return err
+	}
+
+	if err := cursorStore.SetValue(value); err != nil {
+		_ = cursorStore.Close()
+		return err
+	}
+	if err := cursorStore.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "Saved %s cursor %s\n", sc.eventType.Name, value)
+	return nil
+}
+
+// describeCursor summarises a saved cursor.
+func describeCursor(value string) string {
+	cursor, err := api.ParseCursor(value)
+	if err != nil {
+		return "invalid cursor"
+	}
+	if cursor.IsContinuation() {
+		return "continuation cursor"
+	}
+	return "reset cursor, events " + describeWindow(cursor)
+}
+
+func formatRecordTime(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return t.Local().Format(time.RFC3339)
+}
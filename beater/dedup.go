@@ -0,0 +1,129 @@
+package beater
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"go.1password.io/eventsapibeat/api"
+	"go.1password.io/eventsapibeat/config"
+	"go.1password.io/eventsapibeat/store"
+)
+
+// dedupFilter drops the events of a stream that were already published, as
+// recorded by the cursor tracker of the stream in seen. Events without a UUID
+// are never dropped.
+type dedupFilter struct {
+	name       string
+	seen       *store.UUIDSet
+	suppressed *monitoring.Int
+	log        *logp.Logger
+
+	// The UUIDs recorded by the ACK handler are written to seen in the
+	// background, so that acknowledging events never waits for the file.
+	mu      sync.Mutex
+	pending []string
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+// newDedupFilter opens the UUID set of the stream name in the dedup directory,
+// and reports the number of suppressed events in the registry of the stream.
+func newDedupFilter(c config.DedupConfig, name string, registry *monitoring.Registry, log *logp.Logger) (*dedupFilter, error) {
+	if err := os.MkdirAll(c.Path, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create dedup directory. %w", err)
+	}
+	seen, err := store.OpenUUIDSet(filepath.Join(c.Path, name+".uuids"), c.Window, c.MaxEntries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s dedup file. %w", name, err)
+	}
+
+	reg := registry.GetRegistry(name)
+	if reg == nil {
+		reg = registry.NewRegistry(name)
+	} else {
+		_ = reg.Clear()
+	}
+	f := &dedupFilter{
+		name:       name,
+		seen:       seen,
+		suppressed: monitoring.NewInt(reg, "suppressed"),
+		log:        log,
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	go f.writePending()
+	return f, nil
+}
+
+// filter returns the events that were not published yet and their UUIDs. A
+// nil filter keeps every event.
+func (f *dedupFilter) filter(events []api.Event) ([]api.Event, []string) {
+	kept := make([]api.Event, 0, len(events))
+	uuids := make([]string, 0, len(events))
+	for _, e := range events {
+		uuid := e.EventUUID()
+		if f != nil && uuid != "" && f.seen.Contains(uuid) {
+			f.suppressed.Inc()
+			continue
+		}
+		kept = append(kept, e)
+		uuids = append(uuids, uuid)
+	}
+	return kept, uuids
+}
+
+// record queues the UUID of a published event to be added to the set.
+func (f *dedupFilter) record(uuid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.pending = append(f.pending, uuid)
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writePending adds the queued UUIDs to the set, in batches, until the filter
+// is closed.
+func (f *dedupFilter) writePending() {
+	defer close(f.done)
+	for range f.wake {
+		f.flush()
+	}
+	f.flush()
+}
+
+func (f *dedupFilter) flush() {
+	f.mu.Lock()
+	uuids := f.pending
+	f.pending = nil
+	f.mu.Unlock()
+
+	if len(uuids) == 0 {
+		return
+	}
+	if err := f.seen.Add(uuids...); err != nil {
+		f.log.Warnf("failed to record %d published %s events: %v", len(uuids), f.name, err)
+	}
+}
+
+// Close writes the queued UUIDs and closes the set.
+func (f *dedupFilter) Close() error {
+	f.mu.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.wake)
+	}
+	f.mu.Unlock()
+
+	<-f.done
+	return f.seen.Close()
+}
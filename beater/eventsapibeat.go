@@ -4,24 +4,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strings"
-	"time"
+	"sync"
 
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/acker"
+	"github.com/elastic/beats/v7/libbeat/common/cfgwarn"
+	"github.com/elastic/beats/v7/libbeat/esleg/eslegclient"
 	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/paths"
 	"go.1password.io/eventsapibeat/api"
 	"go.1password.io/eventsapibeat/config"
 	"go.1password.io/eventsapibeat/store"
-	"go.1password.io/eventsapibeat/utils"
 	"go.1password.io/eventsapibeat/version"
 )
 
 const (
-	BeatName           = "eventsapibeat"
-	SignInAttemptsType = "signinattempts"
-	ItemUsagesType     = "itemusages"
-	AuditEventsType    = "auditevents"
+	BeatName = "eventsapibeat"
 )
 
 type EventsAPIBeat struct {
@@ -30,321 +30,278 @@ type EventsAPIBeat struct {
 	beatClient beat.Client
 	log        *logp.Logger
 
-	ctx                       context.Context
-	cancel                    context.CancelFunc
-	signInAttemptsCursorStore store.CursorStore
-	itemUsagesCursorStore     store.CursorStore
-	auditEventsCursorStore    store.CursorStore
-	apiClient                 *api.Client
+	ctx             context.Context
+	cancel          context.CancelFunc
+	streams         []*stream
+	cursorBackend   store.Backend
+	apiClient       *api.Client
+	streamsRegistry *monitoring.Registry
 }
 
-func New(_ *beat.Beat, cfg *common.Config) (beat.Beater, error) {
+func New(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
 
 	var err error
 	eventsAPIBeat := &EventsAPIBeat{
-		log:    logp.NewLogger(BeatName),
-		config: config.DefaultConfig,
+		log: logp.NewLogger(BeatName),
 	}
 
-	if err = cfg.Unpack(&eventsAPIBeat.config); err != nil {
-		return nil, fmt.Errorf("failed to unpack config file. %v", err)
+	eventsAPIBeat.config, err = loadConfig(cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	if err = eventsAPIBeat.config.Validate(); err != nil {
-		return nil, fmt.Errorf("invalid config. %v", err)
+	eventsAPIBeat.streamsRegistry = monitoring.Default.GetRegistry(BeatName + ".streams")
+	if eventsAPIBeat.streamsRegistry == nil {
+		eventsAPIBeat.streamsRegistry = monitoring.Default.NewRegistry(BeatName + ".streams")
 	}
 
-	eventsAPIBeat.apiClient, err = api.NewClient(
-		&leveledLoggerWrapper{
-			eventsAPIBeat.log,
-		},
-		eventsAPIBeat.config.InsecureSkipVerify,
-	)
+	dedupRegistry := monitoring.Default.GetRegistry(BeatName + ".dedup")
+	if dedupRegistry == nil {
+		dedupRegistry = monitoring.Default.NewRegistry(BeatName + ".dedup")
+	}
+
+	eventsAPIBeat.apiClient, err = newAPIClient(eventsAPIBeat.config, 0, eventsAPIBeat.log)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create api client. %w", err)
+		return nil, err
 	}
 
-	if eventsAPIBeat.config.SignInAttempts.Enabled {
-		eventsAPIBeat.signInAttemptsCursorStore, err = store.NewCursorHistoryFileStore(eventsAPIBeat.config.SignInAttempts.CursorStateFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open sign-in attempts cursor file. %w", err)
-		}
+	streamConfigs, err := loadStreamConfigs(cfg, eventsAPIBeat.config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config. %v", err)
 	}
 
-	if eventsAPIBeat.config.ItemUsages.Enabled {
-		eventsAPIBeat.itemUsagesCursorStore, err = store.NewCursorHistoryFileStore(eventsAPIBeat.config.ItemUsages.CursorStateFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open item usages cursor file. %w", err)
-		}
+	var output common.ConfigNamespace
+	if b != nil && b.Config != nil {
+		output = b.Config.Output
+	}
+	if eventsAPIBeat.config.DataStream.Enabled && output.IsSet() && output.Name() != "elasticsearch" {
+		eventsAPIBeat.log.Warnf("data_stream routes events with @metadata.raw_index, which the %s output ignores", output.Name())
+	}
+	eventsAPIBeat.cursorBackend, err = newCursorBackend(eventsAPIBeat.config.CursorStore, output, eventsAPIBeat.log)
+	if err != nil {
+		return nil, err
 	}
 
-	if eventsAPIBeat.config.AuditEvents.Enabled {
-		eventsAPIBeat.auditEventsCursorStore, err = store.NewCursorHistoryFileStore(eventsAPIBeat.config.AuditEvents.CursorStateFile)
+	for _, sc := range streamConfigs {
+		if !sc.config.Enabled {
+			continue
+		}
+
+		cursorStore, err := eventsAPIBeat.cursorBackend.Open(sc.eventType.Name, sc.config.CursorStateFile)
 		if err != nil {
-			return nil, fmt.Errorf("failed to open audit events cursor file. %w", err)
+			eventsAPIBeat.closeCursorStores()
+			return nil, fmt.Errorf("failed to open %s cursor file. %w", sc.eventType.Name, err)
+		}
+		s := newStream(sc.eventType, sc.config, eventsAPIBeat.apiClient, cursorStore, eventsAPIBeat.log)
+		s.documentID = eventsAPIBeat.config.DocumentID
+		s.dataStream = eventsAPIBeat.config.DataStream
+		s.onInvalidCursor = eventsAPIBeat.config.OnInvalidCursor
+		eventsAPIBeat.streams = append(eventsAPIBeat.streams, s)
+
+		if eventsAPIBeat.config.Dedup.Enabled {
+			dedup, err := newDedupFilter(eventsAPIBeat.config.Dedup, sc.eventType.Name, dedupRegistry, eventsAPIBeat.log)
+			if err != nil {
+				eventsAPIBeat.closeCursorStores()
+				return nil, err
+			}
+			s.setDedup(dedup)
 		}
 	}
 
 	return eventsAPIBeat, nil
 }
 
-func (e *EventsAPIBeat) Run(b *beat.Beat) error {
-	e.log.Infof("%s v%s is running! Hit CTRL-C to stop it.", BeatName, version.Version)
-	e.ctx, e.cancel = context.WithCancel(context.Background())
+// loadConfig unpacks and validates the beat configuration.
+func loadConfig(cfg *common.Config) (config.Config, error) {
+	c := config.DefaultConfig
+	if err := cfg.Unpack(&c); err != nil {
+		return c, fmt.Errorf("failed to unpack config file. %v", err)
+	}
 
-	var err error
-	e.beatClient, err = b.Publisher.Connect()
-	if err != nil {
-		return err
+	if err := c.Validate(); err != nil {
+		return c, fmt.Errorf("invalid config. %v", err)
 	}
 
-	eventsChan := make(chan *beat.Event)
-	errorChan := make(chan error)
+	if c.InsecureSkipVerify {
+		cfgwarn.Deprecate("3.0.0", "insecure_skip_verify is deprecated, use ssl.verification_mode: none instead")
+	}
+	return c, nil
+}
 
-	if e.config.SignInAttempts.Enabled {
-		e.log.Info("Starting sign-in attempts loop")
-		jwt, err := utils.ParseJWTClaims(e.config.SignInAttempts.AuthToken)
+// newCursorBackend opens the backend selected by cursor_store. The
+// elasticsearch backend connects with the settings of output, unless it has
+// its own.
+func newCursorBackend(c config.CursorStoreConfig, output common.ConfigNamespace, log *logp.Logger) (store.Backend, error) {
+	switch c.Type {
+	case config.CursorStoreJSON:
+		backend, err := store.NewJSONBackend(c.Path)
 		if err != nil {
-			return err
-		}
-
-		if !jwt.Features.Contains(utils.SignInAttemptsFeatureScope) {
-			return errors.New("sign-in attempt token does not have sign-in attempt feature")
+			return nil, fmt.Errorf("failed to open cursor store. %w", err)
 		}
-		go func() {
-			err := e.signInAttemptsLoop(eventsChan)
-			if err != nil {
-				errorChan <- fmt.Errorf("failed when processing sign-in attempts. %v", err)
+		return backend, nil
+	case config.CursorStoreElasticsearch:
+		esConfig := c.Elasticsearch
+		if esConfig == nil {
+			if output.Name() != "elasticsearch" {
+				return nil, fmt.Errorf("cursor_store.elasticsearch is required when the output is not elasticsearch")
 			}
-		}()
-	}
-
-	if e.config.ItemUsages.Enabled {
-		e.log.Info("Starting item usages loop")
-		jwt, err := utils.ParseJWTClaims(e.config.ItemUsages.AuthToken)
+			esConfig = output.Config()
+		}
+		conn, err := eslegclient.NewConnectedClient(esConfig, BeatName)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to connect to the cursor store. %w", err)
 		}
-
-		if !jwt.Features.Contains(utils.ItemUsageFeatureScope) {
-			return errors.New("item usage token does not have item usage feature")
+		backend, err := store.NewElasticsearchBackend(conn, c.Index, c.Account)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open cursor store. %w", err)
 		}
-		go func() {
-			err := e.itemUsagesLoop(eventsChan)
-			if err != nil {
-				errorChan <- fmt.Errorf("failed when processing item usages. %v", err)
-			}
-		}()
-	}
-
-	if e.config.AuditEvents.Enabled {
-		e.log.Info("Starting audit events loop")
-		jwt, err := utils.ParseJWTClaims(e.config.AuditEvents.AuthToken)
+		return backend, nil
+	case config.CursorStoreRegistry:
+		backend, err := store.NewRegistryBackend(log, paths.Resolve(paths.Data, c.RegistryPath))
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to open cursor store. %w", err)
 		}
+		return backend, nil
+	case config.CursorStoreMemory:
+		return store.NewMemoryBackend(), nil
+	default:
+		return store.NewFileBackend(), nil
+	}
+}
 
-		if !jwt.Features.Contains(utils.AuditEventsFeatureScope) {
-			return errors.New("audit events token does not have audit events feature")
-		}
-		go func() {
-			err := e.auditEventsLoop(eventsChan)
-			if err != nil {
-				errorChan <- fmt.Errorf("failed when processing audit events. %v", err)
-			}
-		}()
+// newAPIClient creates the Events API client shared by every stream. A
+// requestsPerSecond of 0 means no limit.
+func newAPIClient(c config.Config, requestsPerSecond float64, log *logp.Logger) (*api.Client, error) {
+	apiRegistry := monitoring.Default.GetRegistry(BeatName + ".api")
+	if apiRegistry == nil {
+		apiRegistry = monitoring.Default.NewRegistry(BeatName + ".api")
+	} else {
+		_ = apiRegistry.Clear()
 	}
 
-	for {
-		select {
-		case <-e.ctx.Done():
-			return nil
-		case ev := <-eventsChan:
-			// publish event to beat
-			e.beatClient.Publish(*ev)
-		case err := <-errorChan:
-			return err
-		}
+	transport := c.TransportSettings()
+	client, err := api.NewClient(
+		&leveledLoggerWrapper{
+			log,
+		},
+		api.ClientConfig{
+			Transport:         &transport,
+			MaxRetries:        c.Retry.MaxRetries,
+			MaxRetryElapsed:   c.Retry.MaxElapsed,
+			Metrics:           apiRegistry,
+			RequestsPerSecond: requestsPerSecond,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create api client. %w", err)
 	}
+	return client, nil
 }
 
-func (e *EventsAPIBeat) signInAttemptsLoop(c chan<- *beat.Event) error {
-	ticker := time.NewTicker(e.config.SignInAttempts.SampleFrequency)
-	defer ticker.Stop()
+func (e *EventsAPIBeat) Run(b *beat.Beat) error {
+	e.log.Infof("%s v%s is running! Hit CTRL-C to stop it.", BeatName, version.Version)
+	e.ctx, e.cancel = context.WithCancel(context.Background())
 
-	cursor, err := e.signInAttemptsCursorStore.GetValue()
+	var err error
+	e.beatClient, err = b.Publisher.ConnectWith(beat.ClientConfig{
+		PublishMode: beat.GuaranteedSend,
+		ACKHandler:  acker.ConnectionOnly(acker.EventPrivateReporter(ackCursorPages)),
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get sign-in attempts cursor. %v", err)
-	}
-	if cursor == "" {
-		cursor = e.config.SignInAttempts.StartingCursor
+		return err
 	}
 
-	for {
-		select {
-		case <-ticker.C:
-			var errs []string
-
-			for {
-				signInAttemptsResponse, err := e.apiClient.SignInAttempts(e.ctx, e.config.SignInAttempts.AuthToken, cursor)
-				if err != nil {
-					errs = append(errs, fmt.Sprintf("failed to fetch sign-in attempts. %v", err))
-					break
-				}
-
-				for i := range signInAttemptsResponse.Items {
-					item := &signInAttemptsResponse.Items[i]
-
-					event := item.BeatEvent()
-					_, _ = event.PutValue("@metadata.event_type", SignInAttemptsType)
-
-					c <- event
-				}
-
-				cursor = fmt.Sprintf(`{ "cursor": "%s" }`, signInAttemptsResponse.Cursor)
-
-				if err := e.signInAttemptsCursorStore.SetValue(cursor); err != nil {
-					errs = append(errs, fmt.Sprintf("failed to set sign-in attempts cursor. %v", err))
-				}
-
-				if !signInAttemptsResponse.HasMore {
-					break
-				}
+	eventsChan := make(chan *beat.Event)
+	var supervisors []*supervisor
 
-			}
+	for _, s := range e.streams {
+		s := s
+		sup := e.newSupervisor(s.eventType.Name, func(ctx context.Context) error {
+			return s.run(ctx, eventsChan)
+		})
 
-			if len(errs) > 0 {
-				return fmt.Errorf(strings.Join(errs, "."))
+		if err := s.verifyToken(e.ctx, e.log); err != nil {
+			if e.config.OnInvalidToken != config.OnInvalidTokenDisable {
+				return err
 			}
+			e.log.Errorf("Disabling %s stream: %v", s.eventType.Name, err)
+			sup.setState(streamStateStopped, err.Error())
+			continue
 		}
+		supervisors = append(supervisors, sup)
 	}
-}
-
-func (e *EventsAPIBeat) itemUsagesLoop(c chan<- *beat.Event) error {
-	ticker := time.NewTicker(e.config.ItemUsages.SampleFrequency)
-	defer ticker.Stop()
-
-	cursor, err := e.itemUsagesCursorStore.GetValue()
-	if err != nil {
-		return fmt.Errorf("failed to get item usages cursor. %v", err)
+	if len(e.streams) > 0 && len(supervisors) == 0 {
+		return errors.New("all streams have been disabled")
 	}
-	if cursor == "" {
-		cursor = e.config.ItemUsages.StartingCursor
+
+	// stopped is only closed once every stream has stopped on a fatal error,
+	// healthy streams keep running when another one fails.
+	var stopped chan struct{}
+	if len(supervisors) > 0 {
+		stopped = make(chan struct{})
+		var wg sync.WaitGroup
+		for _, s := range supervisors {
+			e.log.Infof("Starting %s loop", s.name)
+			wg.Add(1)
+			go func(s *supervisor) {
+				defer wg.Done()
+				_ = s.Run(e.ctx)
+			}(s)
+		}
+		go func() {
+			wg.Wait()
+			close(stopped)
+		}()
 	}
 
 	for {
 		select {
-		case <-ticker.C:
-			var errs []string
-
-			for {
-				itemUsagesResponse, err := e.apiClient.ItemUsages(e.ctx, e.config.ItemUsages.AuthToken, cursor)
-				if err != nil {
-					errs = append(errs, fmt.Sprintf("failed to fetch item usages. %v", err))
-					break
-				}
-
-				for i := range itemUsagesResponse.Items {
-					item := &itemUsagesResponse.Items[i]
-
-					event := item.BeatEvent()
-					_, _ = event.PutValue("@metadata.event_type", ItemUsagesType)
-
-					c <- event
-				}
-
-				cursor = fmt.Sprintf(`{ "cursor": "%s" }`, itemUsagesResponse.Cursor)
-
-				if err := e.itemUsagesCursorStore.SetValue(cursor); err != nil {
-					errs = append(errs, fmt.Sprintf("failed to set item usages cursor. %v", err))
-				}
-
-				if !itemUsagesResponse.HasMore {
-					break
-				}
-
-			}
-
-			if len(errs) > 0 {
-				return fmt.Errorf(strings.Join(errs, "."))
+		case <-e.ctx.Done():
+			return nil
+		case ev := <-eventsChan:
+			// publish event to beat
+			e.beatClient.Publish(*ev)
+		case <-stopped:
+			if e.ctx.Err() != nil {
+				return nil
 			}
+			return errors.New("all streams have stopped")
 		}
 	}
 }
 
-func (e *EventsAPIBeat) auditEventsLoop(c chan<- *beat.Event) error {
-	ticker := time.NewTicker(e.config.AuditEvents.SampleFrequency)
-	defer ticker.Stop()
+func (e *EventsAPIBeat) newSupervisor(name string, run func(ctx context.Context) error) *supervisor {
+	return newSupervisor(name, run, e.log, e.streamsRegistry, e.config.Backoff.Init, e.config.Backoff.Max)
+}
 
-	cursor, err := e.auditEventsCursorStore.GetValue()
+func (e *EventsAPIBeat) Stop() {
+	e.cancel()
+	// Close the publisher client first, acknowledgements that are still in
+	// flight may persist cursors until it returns.
+	err := e.beatClient.Close()
 	if err != nil {
-		return fmt.Errorf("failed to get audit events cursor. %v", err)
-	}
-	if cursor == "" {
-		cursor = e.config.AuditEvents.StartingCursor
-	}
-
-	for {
-		select {
-		case <-ticker.C:
-			var errs []string
-
-			for {
-				auditEventsResponse, err := e.apiClient.AuditEvents(e.ctx, e.config.AuditEvents.AuthToken, cursor)
-				if err != nil {
-					errs = append(errs, fmt.Sprintf("failed to fetch audit events. %v", err))
-					break
-				}
-
-				for i := range auditEventsResponse.AuditEvents {
-					item := &auditEventsResponse.AuditEvents[i]
-
-					event := item.BeatEvent()
-					_, _ = event.PutValue("@metadata.event_type", AuditEventsType)
-
-					c <- event
-				}
-
-				cursor = fmt.Sprintf(`{ "cursor": "%s" }`, auditEventsResponse.Cursor)
-
-				if err := e.auditEventsCursorStore.SetValue(cursor); err != nil {
-					errs = append(errs, fmt.Sprintf("failed to set audit events cursor. %v", err))
-				}
-
-				if !auditEventsResponse.HasMore {
-					break
-				}
-
-			}
-
-			if len(errs) > 0 {
-				return fmt.Errorf(strings.Join(errs, "."))
-			}
-		}
+		e.log.Error(err)
 	}
+	e.closeCursorStores()
 }
 
-func (e *EventsAPIBeat) Stop() {
-	e.cancel()
-	if e.signInAttemptsCursorStore != nil {
-		if err := e.signInAttemptsCursorStore.Close(); err != nil {
-			e.log.Errorf("failed to close sign-in attempts cursor state file: %w", err)
+func (e *EventsAPIBeat) closeCursorStores() {
+	for _, s := range e.streams {
+		s.cursors.Close()
+		if err := s.cursorStore.Close(); err != nil {
+			e.log.Errorf("failed to close %s cursor state file: %v", s.eventType.Name, err)
 		}
-	}
-	if e.itemUsagesCursorStore != nil {
-		if err := e.itemUsagesCursorStore.Close(); err != nil {
-			e.log.Errorf("failed to close item usages cursor state file: %w", err)
+		if s.dedup != nil {
+			if err := s.dedup.Close(); err != nil {
+				e.log.Errorf("failed to close %s dedup file: %v", s.eventType.Name, err)
+			}
 		}
 	}
-	if e.auditEventsCursorStore != nil {
-		if err := e.auditEventsCursorStore.Close(); err != nil {
-			e.log.Errorf("failed to close audit events cursor state file: %w", err)
+	if e.cursorBackend != nil {
+		if err := e.cursorBackend.Close(); err != nil {
+			e.log.Errorf("failed to close cursor store: %v", err)
 		}
 	}
-	err := e.beatClient.Close()
-	if err != nil {
-		e.log.Error(err)
-	}
 }
 
 type leveledLoggerWrapper struct {
@@ -0,0 +1,229 @@
+package beater
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"go.1password.io/eventsapibeat/api"
+)
+
+// Output formats of the fetch command.
+const (
+	// FetchFormatRaw prints the items as returned by the Events API.
+	FetchFormatRaw = "raw"
+	// FetchFormatECS prints the ECS documents the beat would publish.
+	FetchFormatECS = "ecs"
+	// FetchFormatCSV prints the FetchOptions.Columns of the ECS documents.
+	FetchFormatCSV = "csv"
+)
+
+// DefaultFetchColumns are the CSV columns printed by default.
+var DefaultFetchColumns = []string{"@timestamp", "onepassword.uuid", "event.action", "user.id", "user.email", "source.ip"}
+
+// FetchOptions selects the events printed by the fetch command. Empty filters
+// match every event.
+type FetchOptions struct {
+	// Stream is the name or configuration key of the stream, e.g. auditevents
+	// or audit_events.
+	Stream string
+	From   time.Time
+	To     time.Time
+
+	UserUUID  string
+	Action    string
+	VaultUUID string
+	IP        string
+
+	// Format is one of FetchFormatRaw, FetchFormatECS or FetchFormatCSV.
+	Format string
+	// Columns are the dotted ECS fields printed in the CSV format. They
+	// default to DefaultFetchColumns.
+	Columns []string
+}
+
+func (o *FetchOptions) validate() error {
+	switch o.Format {
+	case FetchFormatRaw, FetchFormatECS, FetchFormatCSV:
+	default:
+		return fmt.Errorf("format must be %s, %s or %s", FetchFormatRaw, FetchFormatECS, FetchFormatCSV)
+	}
+	if !o.To.After(o.From) {
+		return fmt.Errorf("--to must be after --from")
+	}
+	if len(o.Columns) == 0 {
+		o.Columns = DefaultFetchColumns
+	}
+	return nil
+}
+
+// matches reports whether the ECS document of an event passes the filters.
+func (o *FetchOptions) matches(doc common.MapStr) bool {
+	if o.UserUUID != "" && fieldString(doc, "user.id") != o.UserUUID {
+		return false
+	}
+	if o.Action != "" && fieldString(doc, "event.action") != o.Action {
+		return false
+	}
+	if o.IP != "" && fieldString(doc, "source.ip") != o.IP {
+		return false
+	}
+	if o.VaultUUID != "" {
+		vault := fieldString(doc, "onepassword.vault_uuid")
+		if vault == "" && fieldString(doc, "onepassword.object_type") == "vault" {
+			vault = fieldString(doc, "onepassword.object_uuid")
+		}
+		if vault != o.VaultUUID {
+			return false
+		}
+	}
+	return true
+}
+
+// Fetch writes the events of a stream in a time range to w, one JSON document
+// per line or as CSV, and returns the number of events written. It reads the
+// stream token and the transport settings from cfg, the beat configuration,
+// but never reads or writes cursor state files.
+func Fetch(ctx context.Context, cfg *common.Config, options FetchOptions, w io.Writer) (int, error) {
+	if err := options.validate(); err != nil {
+		return 0, err
+	}
+
+	log := logp.NewLogger(BeatName)
+	c, err := loadConfig(cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	sc, err := findStreamConfig(cfg, c, options.Stream)
+	if err != nil {
+		return 0, err
+	}
+
+	client, err := newAPIClient(c, 0, log)
+	if err != nil {
+		return 0, err
+	}
+	if sc.config.EventsAPIURL != "" {
+		client = client.WithBaseURL(sc.config.EventsAPIURL)
+	}
+
+	var csvWriter *csv.Writer
+	if options.Format == FetchFormatCSV {
+		csvWriter = csv.NewWriter(w)
+		if err := csvWriter.Write(options.Columns); err != nil {
+			return 0, err
+		}
+		defer csvWriter.Flush()
+	}
+
+	from, to := options.From, options.To
+	cursor := api.Cursor{Limit: sc.config.Limit, StartTime: &from, EndTime: &to}
+	written := 0
+	for {
+		page, err := client.Events(ctx, sc.config.AuthToken, sc.eventType, cursor)
+		if err != nil {
+			return written, fmt.Errorf("failed to fetch %s. %w", sc.eventType.Name, err)
+		}
+
+		for i, item := range page.Events {
+			doc, err := ecsDocument(beatEvent(sc.eventType, item, c.DataStream))
+			if err != nil {
+				return written, err
+			}
+			if !options.matches(doc) {
+				continue
+			}
+
+			switch options.Format {
+			case FetchFormatRaw:
+				err = writeLine(w, page.Raw[i])
+			case FetchFormatECS:
+				err = writeJSONLine(w, doc)
+			case FetchFormatCSV:
+				err = csvWriter.Write(csvRecord(doc, options.Columns))
+			}
+			if err != nil {
+				return written, fmt.Errorf("failed to write event. %w", err)
+			}
+			written++
+		}
+
+		if !page.HasMore {
+			if csvWriter != nil {
+				csvWriter.Flush()
+				return written, csvWriter.Error()
+			}
+			return written, nil
+		}
+		cursor, err = api.ContinuationCursor(page.Cursor)
+		if err != nil {
+			return written, fmt.Errorf("invalid %s page. %w", sc.eventType.Name, err)
+		}
+	}
+}
+
+// ecsDocument returns the ECS document of an event, as it would be indexed.
+func ecsDocument(event *beat.Event) (common.MapStr, error) {
+	b, err := json.Marshal(event.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode event. %w", err)
+	}
+
+	var doc common.MapStr
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("failed to decode event. %w", err)
+	}
+	doc["@timestamp"] = event.Timestamp.UTC().Format(time.RFC3339Nano)
+	return doc, nil
+}
+
+func fieldString(doc common.MapStr, key string) string {
+	v, err := doc.GetValue(key)
+	if err != nil || v == nil {
+		return ""
+	}
+	switch t := v.(type) {
+	case string:
+		return t
+	case map[string]interface{}, common.MapStr, []interface{}:
+		b, _ := json.Marshal(t)
+		return string(b)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+func csvRecord(doc common.MapStr, columns []string) []string {
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		record[i] = fieldString(doc, column)
+	}
+	return record
+}
+
+func writeLine(w io.Writer, raw json.RawMessage) error {
+	var b bytes.Buffer
+	if err := json.Compact(&b, raw); err != nil {
+		return err
+	}
+	b.WriteByte('\n')
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func writeJSONLine(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
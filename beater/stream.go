@@ -0,0 +1,384 @@
+package beater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/beat/events"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"go.1password.io/eventsapibeat/api"
+	"go.1password.io/eventsapibeat/config"
+	"go.1password.io/eventsapibeat/store"
+	"go.1password.io/eventsapibeat/utils"
+)
+
+// streamConfig pairs an event type with the settings of its stream.
+type streamConfig struct {
+	eventType *api.EventType
+	config    config.EventConfig
+}
+
+// loadStreamConfigs resolves the settings of every registered event type and
+// of the custom streams defined in the configuration.
+func loadStreamConfigs(cfg *common.Config, c config.Config) ([]streamConfig, error) {
+	var streams []streamConfig
+	names := map[string]bool{}
+
+	for _, eventType := range api.EventTypes() {
+		var sub *common.Config
+		if cfg.HasField(eventType.ConfigKey) {
+			var err error
+			sub, err = cfg.Child(eventType.ConfigKey, -1)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s. %w", eventType.ConfigKey, err)
+			}
+		}
+
+		eventConfig, err := config.UnpackEventConfig(sub, eventType.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s. %w", eventType.ConfigKey, err)
+		}
+		if eventConfig.EventsAPIURL == "" {
+			eventConfig.EventsAPIURL = c.EventsAPIURL
+		}
+		names[eventType.Name] = true
+		streams = append(streams, streamConfig{eventType: eventType, config: eventConfig})
+	}
+
+	for i, sub := range c.CustomStreams {
+		var custom config.CustomStreamConfig
+		if err := sub.Unpack(&custom); err != nil {
+			return nil, fmt.Errorf("invalid custom_streams.%d. %w", i, err)
+		}
+		if names[custom.Name] {
+			return nil, fmt.Errorf("invalid custom_streams.%d. stream %s is already defined", i, custom.Name)
+		}
+		if c.DataStream.Enabled {
+			if err := custom.ValidateDataStream(); err != nil {
+				return nil, fmt.Errorf("invalid custom_streams.%d. %w", i, err)
+			}
+		}
+
+		fields := make([]api.FieldMapping, len(custom.Fields))
+		for j, f := range custom.Fields {
+			fields[j] = api.FieldMapping{From: f.From, To: f.To, Type: f.Type}
+		}
+		eventType, err := api.NewCustomEventType(custom.Name, custom.Path, custom.FeatureScope, fields)
+		if err != nil {
+			return nil, fmt.Errorf("invalid custom_streams.%d. %w", i, err)
+		}
+
+		eventConfig, err := config.UnpackEventConfig(sub, custom.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid custom_streams.%d. %w", i, err)
+		}
+		if eventConfig.EventsAPIURL == "" {
+			eventConfig.EventsAPIURL = c.EventsAPIURL
+		}
+		names[custom.Name] = true
+		streams = append(streams, streamConfig{eventType: eventType, config: eventConfig})
+	}
+
+	return streams, nil
+}
+
+// findStreamConfig returns the settings of the stream with the given name or
+// configuration key, whether it is enabled or not, provided it has a token.
+func findStreamConfig(cfg *common.Config, c config.Config, name string) (*streamConfig, error) {
+	streamConfigs, err := loadStreamConfigs(cfg, c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config. %v", err)
+	}
+
+	for i := range streamConfigs {
+		sc := &streamConfigs[i]
+		if sc.eventType.Name != name && sc.eventType.ConfigKey != name {
+			continue
+		}
+		if sc.config.AuthToken == "" {
+			return nil, fmt.Errorf("%s has no auth_token", sc.eventType.ConfigKey)
+		}
+		return sc, nil
+	}
+	return nil, fmt.Errorf("unknown stream %s", name)
+}
+
+// stream collects the events of a single registered api.EventType.
+type stream struct {
+	eventType       *api.EventType
+	config          config.EventConfig
+	client          *api.Client
+	cursorStore     store.CursorStore
+	cursors         *cursorTracker
+	dedup           *dedupFilter
+	documentID      config.DocumentIDConfig
+	dataStream      config.DataStreamConfig
+	onInvalidCursor string
+	log             *logp.Logger
+}
+
+func newStream(eventType *api.EventType, eventConfig config.EventConfig, client *api.Client, cursorStore store.CursorStore, log *logp.Logger) *stream {
+	if eventConfig.EventsAPIURL != "" {
+		client = client.WithBaseURL(eventConfig.EventsAPIURL)
+	}
+	return &stream{
+		eventType:       eventType,
+		config:          eventConfig,
+		client:          client,
+		cursorStore:     cursorStore,
+		cursors:         newCursorTracker(eventType.Name, cursorStore, log),
+		onInvalidCursor: config.OnInvalidCursorFail,
+		log:             log,
+	}
+}
+
+// setDedup makes the stream drop the events recorded as published by f.
+func (s *stream) setDedup(f *dedupFilter) {
+	s.dedup = f
+	s.cursors.dedup = f
+}
+
+// setDocumentID sets the @metadata._id of an event as configured by
+// document_id.
+func (s *stream) setDocumentID(event *beat.Event, uuid string) {
+	if !s.documentID.Enabled || uuid == "" {
+		return
+	}
+	event.SetID(api.DocumentID(s.documentID.Account, s.eventType.Name, uuid))
+
+	// The Elasticsearch output creates the documents of events with an ID,
+	// so an event published again would be dropped as a duplicate instead of
+	// replacing its document. Data streams only accept creating documents.
+	if !s.dataStream.Enabled {
+		_, _ = event.Meta.Put(events.FieldMetaOpType, events.OpTypeIndex.String())
+	}
+}
+
+// beatEvent maps an event of t to its document, laid out like the ones of the
+// 1Password integration of Elastic Agent when data_stream is enabled.
+func beatEvent(t *api.EventType, item api.Event, dataStream config.DataStreamConfig) *beat.Event {
+	if dataStream.Enabled {
+		return api.DataStreamEvent(t, item, dataStream.Namespace)
+	}
+	return item.BeatEvent()
+}
+
+// tokenCheckTimeout bounds the introspect request of verifyToken.
+const tokenCheckTimeout = 10 * time.Second
+
+// verifyToken checks that the stream token is valid and carries the feature
+// required by the endpoint, first locally and then with the Events API. When
+// the Events API can't be reached the local check is trusted, the stream fails
+// later on if the token turns out to be invalid.
+func (s *stream) verifyToken(ctx context.Context, log *logp.Logger) error {
+	jwt, err := utils.ParseJWTClaims(s.config.AuthToken)
+	if err != nil {
+		return fmt.Errorf("%s token is malformed. %w", s.eventType.Name, err)
+	}
+
+	if !jwt.Features.Contains(s.eventType.FeatureScope) {
+		return fmt.Errorf("%s token does not have %s feature", s.eventType.Name, s.eventType.FeatureScope)
+	}
+
+	if s.config.EventsAPIURL != "" {
+		u, err := url.Parse(s.config.EventsAPIURL)
+		if err == nil && (len(jwt.Audience) == 0 || u.Host != jwt.Audience[0]) {
+			log.Warnf("events_api_url %s of %s stream does not match its token audience %v", s.config.EventsAPIURL, s.eventType.Name, jwt.Audience)
+		}
+	}
+
+	// A slow or unavailable introspect endpoint must not hold up the startup
+	// for as long as the retry policy allows.
+	introspectCtx, cancel := context.WithTimeout(api.WithoutRetries(ctx), tokenCheckTimeout)
+	defer cancel()
+	introspection, err := s.client.Introspect(introspectCtx, s.config.AuthToken)
+	if err != nil {
+		var apiErr *api.Error
+		if errors.As(err, &apiErr) && apiErr.Unauthorized() {
+			return fmt.Errorf("%s token was rejected by the Events API, it may have been revoked. %w", s.eventType.Name, err)
+		}
+		log.Warnf("Failed to verify %s token with the Events API: %v", s.eventType.Name, err)
+		return nil
+	}
+
+	log.Infof("Using %s token %s issued at %s", s.eventType.Name, introspection.UUID, introspection.IssuedAt.Format(time.RFC3339))
+	if !utils.Features(introspection.Features).Contains(s.eventType.FeatureScope) {
+		return fmt.Errorf("%s token does not have %s feature according to the Events API", s.eventType.Name, s.eventType.FeatureScope)
+	}
+	return nil
+}
+
+// run pages through the endpoint every sample_frequency, sending the events to
+// c, until ctx is cancelled or an error occurs.
+func (s *stream) run(ctx context.Context, c chan<- *beat.Event) error {
+	ticker := time.NewTicker(s.config.SampleFrequency)
+	defer ticker.Stop()
+
+	cursor, err := s.startingCursor()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			cursor, err = s.poll(ctx, cursor, c)
+			if err != nil && isInvalidCursor(err) && cursor.IsContinuation() {
+				cursor, err = s.recoverCursor(err)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// poll pages through the endpoint from cursor until has_more is false, sending
+// the events to c. It returns the cursor of the next poll.
+func (s *stream) poll(ctx context.Context, cursor api.Cursor, c chan<- *beat.Event) (api.Cursor, error) {
+	for {
+		response, err := s.client.Events(ctx, s.config.AuthToken, s.eventType, cursor)
+		if err != nil {
+			return cursor, fmt.Errorf("failed to fetch %s. %w", s.eventType.Name, err)
+		}
+
+		next, err := api.ContinuationCursor(response.Cursor)
+		if err != nil {
+			return cursor, fmt.Errorf("invalid %s page. %w", s.eventType.Name, err)
+		}
+		next.LastEventTime = cursor.LastEventTime
+		if !cursor.IsContinuation() {
+			next.LastEventTime = cursor.StartTime
+		}
+
+		events, uuids := s.dedup.filter(response.Events)
+		if n := len(response.Events) - len(events); n > 0 {
+			s.log.Infof("Suppressed %d %s events that were already published", n, s.eventType.Name)
+		}
+		beatEvents := make([]*beat.Event, len(events))
+		for i, item := range events {
+			beatEvents[i] = beatEvent(s.eventType, item, s.dataStream)
+			if t := beatEvents[i].Timestamp; !t.IsZero() && (next.LastEventTime == nil || t.After(*next.LastEventTime)) {
+				next.LastEventTime = &t
+			}
+		}
+
+		encoded, err := next.Encode()
+		if err != nil {
+			return cursor, fmt.Errorf("failed to encode %s cursor. %w", s.eventType.Name, err)
+		}
+		cursor = next
+		page := s.cursors.AddPage(encoded, uuids)
+
+		for i, event := range beatEvents {
+			event.Private = page
+			s.setDocumentID(event, events[i].EventUUID())
+			_, _ = event.PutValue("@metadata.event_type", s.eventType.Name)
+
+			select {
+			case c <- event:
+			case <-ctx.Done():
+				return cursor, ctx.Err()
+			}
+		}
+
+		if err := s.cursors.Err(); err != nil {
+			return cursor, err
+		}
+
+		if !response.HasMore {
+			return cursor, nil
+		}
+	}
+}
+
+// recoverCursor returns the cursor to continue with after the Events API
+// rejected the cursor of the stream with err. Unless on_invalid_cursor is
+// resume, the stream stops: starting over would publish events again or skip
+// the ones that were not read yet. Otherwise the events are requested again
+// from the time of the last acknowledged event, the events of that exact time
+// are published again.
+func (s *stream) recoverCursor(err error) (api.Cursor, error) {
+	if s.onInvalidCursor != config.OnInvalidCursorResume {
+		return api.Cursor{}, fmt.Errorf("the Events API rejected the %s cursor, it may have expired. Set on_invalid_cursor to %s "+
+			"to resume from the last acknowledged event, or reset the cursor with the cursor command. %w",
+			s.eventType.Name, config.OnInvalidCursorResume, err)
+	}
+
+	// Without an acknowledged page, this is the configured starting cursor.
+	acked, ackedErr := s.startingCursor()
+	if ackedErr != nil {
+		return acked, ackedErr
+	}
+	if !acked.IsContinuation() {
+		s.log.Warnf("The Events API rejected the %s cursor, requesting the events %s: %v", s.eventType.Name, describeWindow(acked), err)
+		return acked, nil
+	}
+	if acked.LastEventTime == nil {
+		return acked, fmt.Errorf("the Events API rejected the %s cursor, the saved cursor has no last event time to resume from. %w", s.eventType.Name, err)
+	}
+
+	cursor, cursorErr := s.config.Cursor(time.Now())
+	if cursorErr != nil {
+		return cursor, fmt.Errorf("invalid %s starting cursor. %w", s.eventType.Name, cursorErr)
+	}
+	// A continuation starting_cursor leaves the defaults of a reset cursor.
+	cursor.Cursor, cursor.LastEventTime = "", nil
+	cursor.StartTime = acked.LastEventTime
+	if err := cursor.Validate(); err != nil {
+		return cursor, fmt.Errorf("can't resume %s from %s. %w", s.eventType.Name, acked.LastEventTime.Format(time.RFC3339), err)
+	}
+	s.log.Warnf("The Events API rejected the %s cursor, requesting the events %s: %v", s.eventType.Name, describeWindow(cursor), err)
+	return cursor, nil
+}
+
+// isInvalidCursor reports whether err is the Events API rejecting the cursor
+// of a request.
+func isInvalidCursor(err error) bool {
+	var apiErr *api.Error
+	return errors.As(err, &apiErr) && apiErr.InvalidCursor()
+}
+
+// startingCursor returns the saved cursor of the stream, or the configured
+// starting cursor when none was saved yet.
+func (s *stream) startingCursor() (api.Cursor, error) {
+	// A restarted stream resumes from the latest acknowledged page.
+	s.cursors.Flush()
+	saved, err := s.cursorStore.GetValue()
+	if err != nil {
+		return api.Cursor{}, fmt.Errorf("failed to get %s cursor. %w", s.eventType.Name, err)
+	}
+	if saved == "" {
+		cursor, err := s.config.Cursor(time.Now())
+		if err != nil {
+			return cursor, fmt.Errorf("invalid %s starting cursor. %w", s.eventType.Name, err)
+		}
+		s.log.Infof("No saved %s cursor, requesting the events %s", s.eventType.Name, describeWindow(cursor))
+		return cursor, nil
+	}
+
+	cursor, err := api.ParseCursor(saved)
+	if err != nil {
+		return cursor, fmt.Errorf("failed to parse %s cursor. %w", s.eventType.Name, err)
+	}
+	return cursor, nil
+}
+
+// describeWindow describes the time window selected by a reset cursor.
+func describeWindow(cursor api.Cursor) string {
+	from := "from the earliest available event"
+	if cursor.StartTime != nil {
+		from = "from " + cursor.StartTime.Format(time.RFC3339)
+	}
+	if cursor.EndTime != nil {
+		return from + " to " + cursor.EndTime.Format(time.RFC3339)
+	}
+	return from + " onwards"
+}
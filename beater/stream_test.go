@@ -0,0 +1,540 @@
+package beater
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/beat/events"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"go.1password.io/eventsapibeat/api"
+	"go.1password.io/eventsapibeat/api/apitest"
+	"go.1password.io/eventsapibeat/config"
+	"go.1password.io/eventsapibeat/store"
+	"go.1password.io/eventsapibeat/store/storetest"
+	"go.1password.io/eventsapibeat/utils"
+)
+
+var testStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func auditEvents(n int, from time.Time) []interface{} {
+	events := make([]interface{}, n)
+	for i := range events {
+		events[i] = api.AuditEvent{
+			UUID:      apitest.NewUUID(),
+			Timestamp: from.Add(time.Duration(i) * time.Second),
+			Action:    "create",
+		}
+	}
+	return events
+}
+
+// newTestStream returns an audit events stream reading from srv with token,
+// whose cursor is kept in backend.
+func newTestStream(t *testing.T, srv *apitest.Server, token string, clientConfig api.ClientConfig, limit int) (*stream, *store.MemoryBackend) {
+	t.Helper()
+
+	client, err := srv.Client(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventConfig, err := config.UnpackEventConfig(nil, api.AuditEventsEventType.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventConfig.AuthToken = token
+	eventConfig.Limit = limit
+
+	backend := store.NewMemoryBackend()
+	cursorStore, err := backend.Open(api.AuditEventsEventType.Name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newStream(api.AuditEventsEventType, eventConfig, client, cursorStore, logp.NewLogger("test"))
+	t.Cleanup(s.cursors.Close)
+	return s, backend
+}
+
+func encodeCursor(t *testing.T, c api.Cursor) string {
+	t.Helper()
+	encoded, err := c.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+// pollAll polls s from cursor, and acknowledges the published events.
+func pollAll(ctx context.Context, s *stream, cursor api.Cursor) (api.Cursor, []*beat.Event, error) {
+	c := make(chan *beat.Event, 1000)
+	cursor, err := s.poll(ctx, cursor, c)
+	close(c)
+
+	var events []*beat.Event
+	var private []interface{}
+	for e := range c {
+		events = append(events, e)
+		private = append(private, e.Private)
+	}
+	ackCursorPages(len(private), private)
+	s.cursors.Flush()
+	return cursor, events, err
+}
+
+func TestStreamPoll(t *testing.T) {
+	tests := []struct {
+		name  string
+		first int
+		then  int
+		limit int
+	}{
+		{name: "no events", first: 0, then: 0, limit: 10},
+		{name: "single page", first: 5, then: 3, limit: 10},
+		{name: "several pages", first: 25, then: 12, limit: 10},
+		{name: "exact pages", first: 20, then: 10, limit: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := apitest.NewServer()
+			defer srv.Close()
+			path := api.AuditEventsEventType.Path
+			if err := srv.AddEvents(path, auditEvents(tt.first, testStart)...); err != nil {
+				t.Fatal(err)
+			}
+
+			s, backend := newTestStream(t, srv, srv.Token(utils.AuditEventsFeatureScope), api.ClientConfig{}, tt.limit)
+			cursor, err := s.startingCursor()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cursor, events, err := pollAll(context.Background(), s, cursor)
+			if err != nil {
+				t.Fatalf("first poll failed: %v", err)
+			}
+			if len(events) != tt.first {
+				t.Fatalf("first poll published %d events, want %d", len(events), tt.first)
+			}
+			if saved, want := backend.Cursor(api.AuditEventsEventType.Name), encodeCursor(t, cursor); saved != want {
+				t.Fatalf("saved cursor %q, want %q", saved, want)
+			}
+
+			// A restarted stream resumes after the events already published.
+			if err := srv.AddEvents(path, auditEvents(tt.then, testStart.Add(time.Hour))...); err != nil {
+				t.Fatal(err)
+			}
+			restarted, err := s.startingCursor()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, events, err = pollAll(context.Background(), s, restarted)
+			if err != nil {
+				t.Fatalf("second poll failed: %v", err)
+			}
+			if len(events) != tt.then {
+				t.Fatalf("second poll published %d events, want %d", len(events), tt.then)
+			}
+		})
+	}
+}
+
+func TestStreamPollFaults(t *testing.T) {
+	tests := []struct {
+		name         string
+		faults       []apitest.Fault
+		maxRetries   int
+		revoke       bool
+		cursor       string
+		wantErr      bool
+		wantStop     bool
+		wantReset    bool
+		wantRequests int
+		minElapsed   time.Duration
+	}{
+		{
+			name:         "retries server errors",
+			faults:       []apitest.Fault{{StatusCode: http.StatusBadGateway}},
+			maxRetries:   2,
+			wantRequests: 2,
+		},
+		{
+			name:         "waits as long as Retry-After",
+			faults:       []apitest.Fault{{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Second}},
+			maxRetries:   2,
+			wantRequests: 2,
+			minElapsed:   time.Second,
+		},
+		{
+			name:         "fails on malformed pages",
+			faults:       []apitest.Fault{{Malformed: true}},
+			maxRetries:   2,
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "rejects empty cursors",
+			faults:       []apitest.Fault{{StatusCode: http.StatusOK, Body: `{"cursor": "", "has_more": false, "items": []}`}},
+			maxRetries:   2,
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "gives up after max retries",
+			faults:       []apitest.Fault{{StatusCode: http.StatusServiceUnavailable}},
+			maxRetries:   0,
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "stops on bad requests",
+			faults:       []apitest.Fault{{StatusCode: http.StatusBadRequest}},
+			maxRetries:   2,
+			wantErr:      true,
+			wantStop:     true,
+			wantRequests: 1,
+		},
+		{
+			name:         "stops on revoked tokens",
+			revoke:       true,
+			maxRetries:   2,
+			wantErr:      true,
+			wantStop:     true,
+			wantRequests: 1,
+		},
+		{
+			name:         "resets rejected cursors",
+			cursor:       "expired",
+			maxRetries:   2,
+			wantErr:      true,
+			wantStop:     true,
+			wantReset:    true,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := apitest.NewServer()
+			defer srv.Close()
+			path := api.AuditEventsEventType.Path
+			if err := srv.AddEvents(path, auditEvents(3, testStart)...); err != nil {
+				t.Fatal(err)
+			}
+			srv.InjectFaults(path, tt.faults...)
+
+			token := srv.Token(utils.AuditEventsFeatureScope)
+			if tt.revoke {
+				srv.Revoke(token)
+			}
+			s, _ := newTestStream(t, srv, token, api.ClientConfig{MaxRetries: tt.maxRetries}, 10)
+			cursor := api.Cursor{StartTime: &testStart}
+			if tt.cursor != "" {
+				cursor = api.Cursor{Cursor: tt.cursor}
+			}
+
+			started := time.Now()
+			_, events, err := pollAll(context.Background(), s, cursor)
+			elapsed := time.Since(started)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("poll returned %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(events) != 3 {
+				t.Errorf("poll published %d events, want 3", len(events))
+			}
+			if err != nil && isRetryable(err) == tt.wantStop {
+				t.Errorf("isRetryable(%v) = %v, want %v", err, isRetryable(err), !tt.wantStop)
+			}
+			if err != nil && isInvalidCursor(err) != tt.wantReset {
+				t.Errorf("isInvalidCursor(%v) = %v, want %v", err, isInvalidCursor(err), tt.wantReset)
+			}
+			if n := srv.Requests(path); n != tt.wantRequests {
+				t.Errorf("server received %d requests, want %d", n, tt.wantRequests)
+			}
+			if elapsed < tt.minElapsed {
+				t.Errorf("poll took %s, want at least %s", elapsed, tt.minElapsed)
+			}
+		})
+	}
+}
+
+func TestStreamRecoverCursor(t *testing.T) {
+	tests := []struct {
+		name            string
+		onInvalidCursor string
+		// acked saves the cursor of a first poll of 3 events, and saved is
+		// saved instead when set, before the Events API rejects a cursor.
+		acked         bool
+		saved         string
+		wantErr       bool
+		wantStartTime time.Time
+		wantEvents    int
+	}{
+		{
+			name:            "fail by default",
+			onInvalidCursor: config.OnInvalidCursorFail,
+			acked:           true,
+			wantErr:         true,
+		},
+		{
+			name:            "resume from last acknowledged event",
+			onInvalidCursor: config.OnInvalidCursorResume,
+			acked:           true,
+			wantStartTime:   testStart.Add(2 * time.Second),
+			wantEvents:      3,
+		},
+		{
+			name:            "resume without acknowledged page",
+			onInvalidCursor: config.OnInvalidCursorResume,
+			wantStartTime:   testStart,
+			wantEvents:      5,
+		},
+		{
+			name:            "saved cursor without last event time",
+			onInvalidCursor: config.OnInvalidCursorResume,
+			saved:           `{"cursor":"old"}`,
+			wantErr:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := apitest.NewServer()
+			defer srv.Close()
+			path := api.AuditEventsEventType.Path
+			if err := srv.AddEvents(path, auditEvents(3, testStart)...); err != nil {
+				t.Fatal(err)
+			}
+
+			s, _ := newTestStream(t, srv, srv.Token(utils.AuditEventsFeatureScope), api.ClientConfig{}, 10)
+			s.config.StartFrom = testStart.Format(time.RFC3339)
+			s.onInvalidCursor = tt.onInvalidCursor
+			if tt.acked {
+				if _, _, err := pollAll(context.Background(), s, api.Cursor{StartTime: &testStart}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.saved != "" {
+				if err := s.cursorStore.SetValue(tt.saved); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := srv.AddEvents(path, auditEvents(2, testStart.Add(3*time.Second))...); err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err := pollAll(context.Background(), s, api.Cursor{Cursor: "expired"})
+			if !isInvalidCursor(err) {
+				t.Fatalf("poll returned %v, want an invalid cursor error", err)
+			}
+			cursor, err := s.recoverCursor(err)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("recoverCursor returned %s, want an error", encodeCursor(t, cursor))
+				}
+				if isRetryable(err) {
+					t.Errorf("isRetryable(%v) = true, want the stream to stop", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cursor.IsContinuation() || cursor.StartTime == nil || !cursor.StartTime.Equal(tt.wantStartTime) {
+				t.Fatalf("recovered cursor is %s, want one starting at %s", encodeCursor(t, cursor), tt.wantStartTime)
+			}
+
+			_, events, err := pollAll(context.Background(), s, cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != tt.wantEvents {
+				t.Errorf("poll published %d events, want %d", len(events), tt.wantEvents)
+			}
+		})
+	}
+}
+
+func TestStreamLastEventTime(t *testing.T) {
+	srv := apitest.NewServer()
+	defer srv.Close()
+	path := api.AuditEventsEventType.Path
+	if err := srv.AddEvents(path, auditEvents(25, testStart)...); err != nil {
+		t.Fatal(err)
+	}
+
+	s, backend := newTestStream(t, srv, srv.Token(utils.AuditEventsFeatureScope), api.ClientConfig{}, 10)
+	cursor, _, err := pollAll(context.Background(), s, api.Cursor{StartTime: &testStart})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved, want := backend.Cursor(api.AuditEventsEventType.Name), encodeCursor(t, cursor); saved != want {
+		t.Errorf("saved cursor %q, want %q", saved, want)
+	}
+	saved, err := api.ParseCursor(backend.Cursor(api.AuditEventsEventType.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testStart.Add(24 * time.Second); saved.LastEventTime == nil || !saved.LastEventTime.Equal(want) {
+		t.Errorf("saved last event time %v, want %s", saved.LastEventTime, want)
+	}
+}
+
+func TestStreamCursorConflict(t *testing.T) {
+	srv := apitest.NewServer()
+	defer srv.Close()
+	path := api.AuditEventsEventType.Path
+	if err := srv.AddEvents(path, auditEvents(3, testStart)...); err != nil {
+		t.Fatal(err)
+	}
+	es := storetest.NewElasticsearch()
+	defer es.Close()
+
+	openStore := func() store.CursorStore {
+		conn, err := es.Connection()
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend, err := store.NewElasticsearchBackend(conn, "eventsapibeat-cursors", "acme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursorStore, err := backend.Open(api.AuditEventsEventType.Name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cursorStore
+	}
+
+	s, _ := newTestStream(t, srv, srv.Token(utils.AuditEventsFeatureScope), api.ClientConfig{}, 10)
+	s.cursorStore = openStore()
+	s.cursors.Close()
+	s.cursors = newCursorTracker(s.eventType.Name, s.cursorStore, s.log)
+	defer s.cursors.Close()
+	if err := openStore().SetValue("saved by another beat"); err != nil {
+		t.Fatal(err)
+	}
+
+	cursor, err := s.startingCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pollAll(context.Background(), s, cursor); err != nil {
+		t.Fatal(err)
+	}
+	// The next poll fails with the error of saving the acknowledged page.
+	err = s.cursors.Err()
+	if !errors.Is(err, store.ErrCursorConflict) {
+		t.Fatalf("saving the cursor failed with %v, want %v", err, store.ErrCursorConflict)
+	}
+	if isRetryable(err) {
+		t.Errorf("isRetryable(%v) = true, want false", err)
+	}
+}
+
+func TestSetDocumentID(t *testing.T) {
+	tests := []struct {
+		name       string
+		documentID config.DocumentIDConfig
+		dataStream bool
+		uuid       string
+		wantID     string
+		wantOpType string
+	}{
+		{name: "disabled", uuid: "56YE2TYN2VFYRLNSHKPW5NVT5E"},
+		{name: "no uuid", documentID: config.DocumentIDConfig{Enabled: true}},
+		{name: "uuid", documentID: config.DocumentIDConfig{Enabled: true}, uuid: "56YE2TYN2VFYRLNSHKPW5NVT5E", wantID: "56YE2TYN2VFYRLNSHKPW5NVT5E", wantOpType: "index"},
+		{name: "account", documentID: config.DocumentIDConfig{Enabled: true, Account: "acme"}, uuid: "56YE2TYN2VFYRLNSHKPW5NVT5E", wantID: "acme:auditevents:56YE2TYN2VFYRLNSHKPW5NVT5E", wantOpType: "index"},
+		{name: "data stream", documentID: config.DocumentIDConfig{Enabled: true}, dataStream: true, uuid: "56YE2TYN2VFYRLNSHKPW5NVT5E", wantID: "56YE2TYN2VFYRLNSHKPW5NVT5E"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &stream{eventType: api.AuditEventsEventType, documentID: tt.documentID}
+			s.dataStream.Enabled = tt.dataStream
+			event := (&api.AuditEvent{UUID: tt.uuid, Timestamp: testStart}).BeatEvent()
+			if len(event.Meta) != 0 {
+				t.Fatalf("BeatEvent set @metadata %v, want it left to the stream", event.Meta)
+			}
+			s.setDocumentID(event, tt.uuid)
+
+			id, _ := event.Meta.GetValue(events.FieldMetaID)
+			if id == nil {
+				id = ""
+			}
+			if id != tt.wantID {
+				t.Errorf("@metadata._id = %v, want %q", id, tt.wantID)
+			}
+			opType := events.GetOpType(*event)
+			if opType.String() != tt.wantOpType {
+				t.Errorf("@metadata.op_type = %v, want %q", opType, tt.wantOpType)
+			}
+		})
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	tests := []struct {
+		name         string
+		features     []string
+		revoke       bool
+		faults       []apitest.Fault
+		wantErr      bool
+		wantRequests int
+	}{
+		{
+			name:         "valid token",
+			features:     []string{utils.AuditEventsFeatureScope},
+			wantRequests: 1,
+		},
+		{
+			name:         "missing feature",
+			features:     []string{utils.SignInAttemptsFeatureScope},
+			wantErr:      true,
+			wantRequests: 0,
+		},
+		{
+			name:         "revoked token",
+			features:     []string{utils.AuditEventsFeatureScope},
+			revoke:       true,
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "introspect unavailable",
+			features:     []string{utils.AuditEventsFeatureScope},
+			faults:       []apitest.Fault{{StatusCode: http.StatusServiceUnavailable}, {StatusCode: http.StatusServiceUnavailable}},
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := apitest.NewServer()
+			defer srv.Close()
+			srv.InjectFaults("/api/auth/introspect", tt.faults...)
+
+			token := srv.Token(tt.features...)
+			if tt.revoke {
+				srv.Revoke(token)
+			}
+			s, _ := newTestStream(t, srv, token, api.ClientConfig{MaxRetries: 10}, 10)
+
+			err := s.verifyToken(context.Background(), logp.NewLogger("test"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyToken returned %v, want error %v", err, tt.wantErr)
+			}
+			var apiErr *api.Error
+			if tt.revoke && !(errors.As(err, &apiErr) && apiErr.Unauthorized()) {
+				t.Errorf("verifyToken returned %v, want an unauthorized error", err)
+			}
+			if n := srv.Requests("/api/auth/introspect"); n != tt.wantRequests {
+				t.Errorf("server received %d introspect requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
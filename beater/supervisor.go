@@ -0,0 +1,115 @@
+package beater
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common/backoff"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"go.1password.io/eventsapibeat/api"
+	"go.1password.io/eventsapibeat/store"
+)
+
+const (
+	streamStateRunning    = "running"
+	streamStateBackingOff = "backing_off"
+	streamStateStopped    = "stopped"
+)
+
+// supervisor runs a single stream, restarting it with exponential backoff and
+// jitter when it fails with a retryable error. A fatal error stops only the
+// supervised stream.
+type supervisor struct {
+	name       string
+	run        func(ctx context.Context) error
+	log        *logp.Logger
+	initDelay  time.Duration
+	maxDelay   time.Duration
+	state      *monitoring.String
+	reason     *monitoring.String
+	restarts   *monitoring.Int
+	lastFailed *monitoring.Timestamp
+}
+
+func newSupervisor(name string, run func(ctx context.Context) error, log *logp.Logger, registry *monitoring.Registry, initDelay, maxDelay time.Duration) *supervisor {
+	reg := registry.GetRegistry(name)
+	if reg == nil {
+		reg = registry.NewRegistry(name)
+	} else {
+		_ = reg.Clear()
+	}
+
+	return &supervisor{
+		name:       name,
+		run:        run,
+		log:        log.With("stream", name),
+		initDelay:  initDelay,
+		maxDelay:   maxDelay,
+		state:      monitoring.NewString(reg, "state"),
+		reason:     monitoring.NewString(reg, "reason"),
+		restarts:   monitoring.NewInt(reg, "restarts"),
+		lastFailed: monitoring.NewTimestamp(reg, "last_failure"),
+	}
+}
+
+// Run blocks until the stream stops with a fatal error or ctx is cancelled.
+// It returns the error that stopped the stream, or nil on cancellation.
+func (s *supervisor) Run(ctx context.Context) error {
+	b := backoff.NewEqualJitterBackoff(ctx.Done(), s.initDelay, s.maxDelay)
+	for {
+		s.setState(streamStateRunning, "")
+		started := time.Now()
+		err := s.run(ctx)
+		if ctx.Err() != nil {
+			s.setState(streamStateStopped, "beat stopped")
+			return nil
+		}
+		if err == nil {
+			err = errors.New("stream exited unexpectedly")
+		}
+		s.lastFailed.Set(time.Now())
+
+		if !isRetryable(err) {
+			s.log.Errorf("Stopping %s stream, the error is not retryable: %v", s.name, err)
+			s.setState(streamStateStopped, err.Error())
+			return err
+		}
+
+		// A stream that was healthy for longer than the maximum delay starts
+		// over with the initial delay.
+		if time.Since(started) > s.maxDelay {
+			b.Reset()
+		}
+		s.log.Warnf("Restarting %s stream after failure: %v", s.name, err)
+		s.setState(streamStateBackingOff, err.Error())
+		if !b.Wait() {
+			s.setState(streamStateStopped, "beat stopped")
+			return nil
+		}
+		s.restarts.Inc()
+	}
+}
+
+func (s *supervisor) setState(state, reason string) {
+	s.state.Set(state)
+	s.reason.Set(reason)
+	s.log.Debugf("%s stream is %s", s.name, state)
+}
+
+// isRetryable reports whether a stream that failed with err should be
+// restarted. Requests the Events API rejected as invalid, in particular with
+// an unauthorized or revoked token, fail again until the configuration is
+// fixed, so retrying them is pointless. So does saving a cursor that another
+// beat changed, the cursor store keeps the version it last read.
+func isRetryable(err error) bool {
+	if errors.Is(err, store.ErrCursorConflict) {
+		return false
+	}
+	var apiErr *api.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/spf13/cobra"
+
+	"go.1password.io/eventsapibeat/beater"
+)
+
+func genBackfillCmd(settings instance.Settings) *cobra.Command {
+	var stream, from, to, stateFile string
+	var slices, concurrency int
+	var requestsPerSecond float64
+
+	backfillCmd := cobra.Command{
+		Use:   "backfill",
+		Short: "Re-ingest the events of a stream in a time range",
+		Long: `Publishes the events of a stream from --from up to --to through the configured output, then exits.
+The cursor of the stream is left untouched. Progress is kept in temporary cursor files, so an
+interrupted backfill resumes when the same command is run again.
+
+With --slices, the time range is split into equal slices fetched concurrently, each with its
+own cursor. The progress of every slice is logged regularly.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if _, _, err := beater.ParseTimeRange(from, to, time.Now()); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+
+			backfill := beater.NewBackfill(beater.BackfillOptions{
+				Stream:            stream,
+				From:              from,
+				To:                to,
+				StateFile:         stateFile,
+				Slices:            slices,
+				Concurrency:       concurrency,
+				RequestsPerSecond: requestsPerSecond,
+			})
+			err := instance.Run(settings, backfill.Create)
+			summary := backfill.Summary()
+			fmt.Println(summary)
+			if err != nil || !summary.Complete {
+				os.Exit(1)
+			}
+		},
+	}
+
+	backfillCmd.Flags().StringVar(&stream, "stream", "", "Stream to backfill, e.g. auditevents")
+	backfillCmd.Flags().StringVar(&from, "from", "", "Start of the time range: an RFC 3339 time, or a duration before now such as 7d")
+	backfillCmd.Flags().StringVar(&to, "to", "now", "End of the time range: now, an RFC 3339 time, or a duration before now")
+	backfillCmd.Flags().StringVar(&stateFile, "state-file", "", "Temporary cursor file, derived from the stream cursor_state_file by default, suffixed with the slice number")
+	backfillCmd.Flags().IntVar(&slices, "slices", 1, "Number of time slices fetched with their own cursor")
+	backfillCmd.Flags().IntVar(&concurrency, "concurrency", 0, "Number of slices fetched at once, all of them by default")
+	backfillCmd.Flags().Float64Var(&requestsPerSecond, "requests-per-second", 0, "Maximum number of Events API requests per second of all slices together, 0 for no limit")
+	_ = backfillCmd.MarkFlagRequired("stream")
+	_ = backfillCmd.MarkFlagRequired("from")
+
+	return &backfillCmd
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/cfgfile"
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/spf13/cobra"
+
+	"go.1password.io/eventsapibeat/beater"
+)
+
+func genCursorCmd(settings instance.Settings) *cobra.Command {
+	cursorCmd := cobra.Command{
+		Use:   "cursor",
+		Short: "Inspect and change the saved cursors of the streams",
+		Long: `Reads and changes the cursor_state_file of each stream. Changes are appended to the file, so
+the earlier cursors stay in its history, and are refused while the beat is running.`,
+	}
+
+	var stream string
+	var n, steps int
+	var before, startFrom string
+
+	listCmd := cobra.Command{
+		Use:   "list",
+		Short: "Print the current cursor of every stream",
+		Run: runCursorCmd(settings, func(c *beater.CursorCommand, args []string) error {
+			return c.List()
+		}),
+	}
+
+	showCmd := cobra.Command{
+		Use:   "show",
+		Short: "Print the current cursor of a stream",
+		Run: runCursorCmd(settings, func(c *beater.CursorCommand, args []string) error {
+			return c.Show(stream)
+		}),
+	}
+
+	historyCmd := cobra.Command{
+		Use:   "history",
+		Short: "Print the saved cursors of a stream with the time they were saved",
+		Run: runCursorCmd(settings, func(c *beater.CursorCommand, args []string) error {
+			return c.History(stream, n)
+		}),
+	}
+	historyCmd.Flags().IntVarP(&n, "number", "n", 0, "Only print the last n cursors")
+
+	rewindCmd := cobra.Command{
+		Use:   "rewind",
+		Short: "Make an earlier cursor of a stream current again",
+		Run: runCursorCmd(settings, func(c *beater.CursorCommand, args []string) error {
+			return c.Rewind(stream, steps, before, time.Now())
+		}),
+	}
+	rewindCmd.Flags().IntVar(&steps, "steps", 1, "Number of saved cursors to go back, as printed by history")
+	rewindCmd.Flags().StringVar(&before, "before", "", "Go back to the last cursor saved before this RFC 3339 time or duration before now")
+
+	resetCmd := cobra.Command{
+		Use:   "reset",
+		Short: "Make the next run of a stream start from a time",
+		Run: runCursorCmd(settings, func(c *beater.CursorCommand, args []string) error {
+			return c.Reset(stream, startFrom, time.Now())
+		}),
+	}
+	resetCmd.Flags().StringVar(&startFrom, "start-from", "", "earliest, now, a duration before now or an RFC 3339 time. Defaults to the configured start")
+
+	setCmd := cobra.Command{
+		Use:   "set CURSOR",
+		Short: "Save a cursor, in its JSON form, as the current cursor of a stream",
+		Args:  cobra.ExactArgs(1),
+		Run: runCursorCmd(settings, func(c *beater.CursorCommand, args []string) error {
+			return c.Set(stream, args[0])
+		}),
+	}
+
+	for _, subCmd := range []*cobra.Command{&showCmd, &historyCmd, &rewindCmd, &resetCmd, &setCmd} {
+		subCmd.Flags().StringVar(&stream, "stream", "", "Stream of the cursor, e.g. auditevents")
+		_ = subCmd.MarkFlagRequired("stream")
+	}
+
+	cursorCmd.AddCommand(&listCmd, &showCmd, &historyCmd, &rewindCmd, &resetCmd, &setCmd)
+	return &cursorCmd
+}
+
+func runCursorCmd(settings instance.Settings, run func(c *beater.CursorCommand, args []string) error) func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		cfg, err := cfgfile.Load("", nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load the configuration: %v\n", err)
+			os.Exit(1)
+		}
+		beatCfg, err := cfg.Child(settings.Name, -1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load the %s configuration: %v\n", settings.Name, err)
+			os.Exit(1)
+		}
+
+		cursorCmd, err := beater.NewCursorCommand(beatCfg, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if err := run(cursorCmd, args); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+}
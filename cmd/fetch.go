@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/cfgfile"
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/spf13/cobra"
+
+	"go.1password.io/eventsapibeat/beater"
+)
+
+func genFetchCmd(settings instance.Settings) *cobra.Command {
+	var options beater.FetchOptions
+	var from, to string
+
+	fetchCmd := cobra.Command{
+		Use:   "fetch",
+		Short: "Print the events of a stream in a time range",
+		Long: `Queries the Events API with the configured token and transport settings, and prints the events
+of a stream from --from up to --to on the standard output. Nothing is published and the cursor
+state files are neither read nor written.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			var err error
+			options.From, options.To, err = beater.ParseTimeRange(from, to, time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+
+			cfg, err := cfgfile.Load("", nil)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load the configuration: %v\n", err)
+				os.Exit(1)
+			}
+			beatCfg, err := cfg.Child(settings.Name, -1)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load the %s configuration: %v\n", settings.Name, err)
+				os.Exit(1)
+			}
+
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer cancel()
+
+			n, err := beater.Fetch(ctx, beatCfg, options, os.Stdout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+			fmt.Fprintf(os.Stderr, "%d events\n", n)
+		},
+	}
+
+	fetchCmd.Flags().StringVar(&options.Stream, "stream", "", "Stream to fetch, e.g. auditevents")
+	fetchCmd.Flags().StringVar(&from, "from", "", "Start of the time range: an RFC 3339 time, or a duration before now such as 24h")
+	fetchCmd.Flags().StringVar(&to, "to", "now", "End of the time range: now, an RFC 3339 time, or a duration before now")
+	fetchCmd.Flags().StringVar(&options.UserUUID, "user", "", "Only print the events of the user with this UUID")
+	fetchCmd.Flags().StringVar(&options.Action, "action", "", "Only print the events with this action")
+	fetchCmd.Flags().StringVar(&options.VaultUUID, "vault", "", "Only print the events of the vault with this UUID")
+	fetchCmd.Flags().StringVar(&options.IP, "ip", "", "Only print the events from this IP address")
+	fetchCmd.Flags().StringVar(&options.Format, "format", beater.FetchFormatECS, "Output format: raw, ecs or csv")
+	fetchCmd.Flags().StringSliceVar(&options.Columns, "columns", beater.DefaultFetchColumns, "ECS fields printed in the csv format")
+	_ = fetchCmd.MarkFlagRequired("stream")
+	_ = fetchCmd.MarkFlagRequired("from")
+
+	return &fetchCmd
+}
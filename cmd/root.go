@@ -5,10 +5,21 @@ import (
 	"github.com/elastic/beats/v7/libbeat/cmd/instance"
 
 	"go.1password.io/eventsapibeat/beater"
+	_ "go.1password.io/eventsapibeat/include"
 )
 
 // Name of this beat
 var Name = beater.BeatName
 
+var settings = instance.Settings{Name: Name}
+
 // RootCmd to handle beats cli
-var RootCmd = cmd.GenRootCmdWithSettings(beater.New, instance.Settings{Name: Name})
+var RootCmd = genRootCmd()
+
+func genRootCmd() *cmd.BeatsRootCmd {
+	rootCmd := cmd.GenRootCmdWithSettings(beater.New, settings)
+	rootCmd.AddCommand(genBackfillCmd(settings))
+	rootCmd.AddCommand(genFetchCmd(settings))
+	rootCmd.AddCommand(genCursorCmd(settings))
+	return rootCmd
+}
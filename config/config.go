@@ -2,60 +2,407 @@ package config
 
 import (
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/transport/httpcommon"
+	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
+	"go.1password.io/eventsapibeat/api"
 )
 
 type Config struct {
-	InsecureSkipVerify bool        `config:"insecure_skip_verify"`
-	SignInAttempts     EventConfig `config:"signin_attempts"`
-	ItemUsages         EventConfig `config:"item_usages"`
-	AuditEvents        EventConfig `config:"audit_events"`
+	// InsecureSkipVerify is deprecated, use ssl.verification_mode: none.
+	InsecureSkipVerify bool                             `config:"insecure_skip_verify"`
+	Transport          httpcommon.HTTPTransportSettings `config:",inline"`
+	EventsAPIURL       string                           `config:"events_api_url"`
+	Backoff            BackoffConfig                    `config:"backoff"`
+	Retry              RetryConfig                      `config:"retry"`
+	OnInvalidToken     string                           `config:"on_invalid_token"`
+	OnInvalidCursor    string                           `config:"on_invalid_cursor"`
+	CustomStreams      []*common.Config                 `config:"custom_streams"`
+	CursorStore        CursorStoreConfig                `config:"cursor_store"`
+	Dedup              DedupConfig                      `config:"dedup"`
+	DocumentID         DocumentIDConfig                 `config:"document_id"`
+	DataStream         DataStreamConfig                 `config:"data_stream"`
+}
+
+// What the beat does at startup when the Events API rejects a stream token.
+const (
+	// OnInvalidTokenFail refuses to start the beat.
+	OnInvalidTokenFail = "fail"
+	// OnInvalidTokenDisable disables the stream and starts the other ones.
+	OnInvalidTokenDisable = "disable"
+)
+
+// What a stream does when the Events API rejects its saved cursor, typically
+// because it expired.
+const (
+	// OnInvalidCursorFail stops the stream until its cursor is reset.
+	OnInvalidCursorFail = "fail"
+	// OnInvalidCursorResume requests the events from the time of the last
+	// acknowledged event of the stream.
+	OnInvalidCursorResume = "resume"
+)
+
+// TransportSettings returns the transport settings of the Events API client,
+// honouring the deprecated insecure_skip_verify setting.
+func (c *Config) TransportSettings() httpcommon.HTTPTransportSettings {
+	settings := c.Transport
+	if c.InsecureSkipVerify {
+		tls := tlscommon.Config{}
+		if settings.TLS != nil {
+			tls = *settings.TLS
+		}
+		tls.VerificationMode = tlscommon.VerifyNone
+		settings.TLS = &tls
+	}
+	return settings
 }
 
 func (c *Config) Validate() error {
-	if err := c.SignInAttempts.Validate(); err != nil {
-		return fmt.Errorf("invalid signin_attempts. %w", err)
+	if err := c.Backoff.Validate(); err != nil {
+		return fmt.Errorf("invalid backoff. %w", err)
 	}
-	if err := c.ItemUsages.Validate(); err != nil {
-		return fmt.Errorf("invalid item_usages. %w", err)
+	if err := c.Retry.Validate(); err != nil {
+		return fmt.Errorf("invalid retry. %w", err)
 	}
-	if err := c.AuditEvents.Validate(); err != nil {
-		return fmt.Errorf("invalid audit_events. %w", err)
+	if err := validateEventsAPIURL(c.EventsAPIURL); err != nil {
+		return err
+	}
+	if c.OnInvalidToken != OnInvalidTokenFail && c.OnInvalidToken != OnInvalidTokenDisable {
+		return fmt.Errorf("on_invalid_token must be %s or %s", OnInvalidTokenFail, OnInvalidTokenDisable)
+	}
+	if c.OnInvalidCursor != OnInvalidCursorFail && c.OnInvalidCursor != OnInvalidCursorResume {
+		return fmt.Errorf("on_invalid_cursor must be %s or %s", OnInvalidCursorFail, OnInvalidCursorResume)
+	}
+	if err := c.CursorStore.Validate(); err != nil {
+		return fmt.Errorf("invalid cursor_store. %w", err)
+	}
+	if err := c.Dedup.Validate(); err != nil {
+		return fmt.Errorf("invalid dedup. %w", err)
+	}
+	if err := c.DataStream.Validate(); err != nil {
+		return fmt.Errorf("invalid data_stream. %w", err)
 	}
 	return nil
 }
 
 var DefaultConfig = Config{
 	InsecureSkipVerify: false,
-	SignInAttempts: EventConfig{
-		Enabled:         false,
-		AuthToken:       "",
-		StartingCursor:  `{ "limit": 1000, "start_time": "2020-01-01T00:00:00Z" }`,
-		CursorStateFile: "eventsapibeat_signinattempts.state",
-		SampleFrequency: 10 * time.Second,
+	Transport:          httpcommon.DefaultHTTPTransportSettings(),
+	Backoff: BackoffConfig{
+		Init: 1 * time.Second,
+		Max:  5 * time.Minute,
 	},
-	ItemUsages: EventConfig{
-		Enabled:         false,
-		AuthToken:       "",
-		StartingCursor:  `{ "limit": 1000, "start_time": "2020-01-01T00:00:00Z" }`,
-		CursorStateFile: "eventsapibeat_itemusages.state",
-		SampleFrequency: 10 * time.Second,
+	Retry: RetryConfig{
+		MaxRetries: 10,
+		MaxElapsed: 15 * time.Minute,
+	},
+	OnInvalidToken:  OnInvalidTokenFail,
+	OnInvalidCursor: OnInvalidCursorFail,
+	CursorStore: CursorStoreConfig{
+		Type:         CursorStoreFile,
+		Path:         "eventsapibeat_cursors.json",
+		RegistryPath: "registry",
+		Index:        "eventsapibeat-cursors",
+		Account:      "default",
+	},
+	Dedup: DedupConfig{
+		Enabled:    false,
+		Path:       "eventsapibeat_dedup",
+		Window:     24 * time.Hour,
+		MaxEntries: 100000,
+	},
+	DataStream: DataStreamConfig{
+		Enabled:   false,
+		Namespace: "default",
 	},
-	AuditEvents: EventConfig{
+}
+
+// DocumentIDConfig controls the @metadata._id of the events, which the
+// Elasticsearch output uses as document ID so that events published again
+// replace their documents instead of duplicating them. Setting document IDs
+// makes indexing more expensive. When Account is not empty, the IDs are
+// namespaced by account and stream.
+type DocumentIDConfig struct {
+	Enabled bool   `config:"enabled"`
+	Account string `config:"account"`
+}
+
+// DataStreamConfig controls the compatibility mode with the 1Password
+// integration of Elastic Agent. When enabled, events are laid out like the
+// ones of the integration and routed to its data streams in Namespace.
+// The dataset and namespace of a data stream name are at most
+// maxDataStreamPart characters long, and can't contain any of
+// invalidDataStreamChars.
+const (
+	maxDataStreamPart      = 100
+	invalidDataStreamChars = `\/*?"<>| ,#:`
+)
+
+type DataStreamConfig struct {
+	Enabled   bool   `config:"enabled"`
+	Namespace string `config:"namespace"`
+}
+
+func (c *DataStreamConfig) Validate() error {
+	if c.Namespace == "" {
+		return fmt.Errorf("namespace can't be empty")
+	}
+	if len(c.Namespace) > maxDataStreamPart {
+		return fmt.Errorf("namespace can't be longer than %d characters", maxDataStreamPart)
+	}
+	if c.Namespace != strings.ToLower(c.Namespace) || strings.ContainsAny(c.Namespace, "-"+invalidDataStreamChars) {
+		return fmt.Errorf("namespace %q is not a valid data stream namespace", c.Namespace)
+	}
+	return nil
+}
+
+// DedupConfig controls the suppression of events that were already published.
+// The UUIDs of the events acknowledged in the last Window, up to MaxEntries per
+// stream, are kept in a file per stream in the directory Path. Window is
+// measured from the acknowledgement of the events, not from their timestamp.
+type DedupConfig struct {
+	Enabled    bool          `config:"enabled"`
+	Path       string        `config:"path"`
+	Window     time.Duration `config:"window"`
+	MaxEntries int           `config:"max_entries"`
+}
+
+func (c *DedupConfig) Validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("path can't be empty")
+	}
+	if c.Window <= 0 {
+		return fmt.Errorf("window must be greater than 0")
+	}
+	if c.MaxEntries <= 0 {
+		return fmt.Errorf("max_entries must be greater than 0")
+	}
+	return nil
+}
+
+// Where the cursors of the streams are kept.
+const (
+	// CursorStoreFile keeps the cursors of every stream in its
+	// cursor_state_file.
+	CursorStoreFile = "file"
+	// CursorStoreJSON keeps the cursors of all the streams in a single JSON
+	// document.
+	CursorStoreJSON = "json"
+	// CursorStoreMemory keeps the cursors in memory, they are lost when the
+	// beat stops.
+	CursorStoreMemory = "memory"
+	// CursorStoreElasticsearch keeps the cursors in an Elasticsearch index.
+	CursorStoreElasticsearch = "elasticsearch"
+	// CursorStoreRegistry keeps the cursors in a libbeat registry, the state
+	// store used by Filebeat.
+	CursorStoreRegistry = "registry"
+)
+
+// CursorStoreConfig selects the backend that keeps the cursors of the streams.
+type CursorStoreConfig struct {
+	Type string `config:"type"`
+	// Path is the file of the json backend.
+	Path string `config:"path"`
+	// RegistryPath is the directory of the registry backend, relative to the
+	// data path of the beat.
+	RegistryPath string `config:"registry_path"`
+	// Index is the index of the elasticsearch backend, which keeps a document
+	// per Account and stream.
+	Index   string `config:"index"`
+	Account string `config:"account"`
+	// Elasticsearch holds the connection settings of the elasticsearch
+	// backend, those of output.elasticsearch are used when it is nil.
+	Elasticsearch *common.Config `config:"elasticsearch"`
+}
+
+func (c *CursorStoreConfig) Validate() error {
+	switch c.Type {
+	case CursorStoreFile, CursorStoreMemory:
+	case CursorStoreJSON:
+		if c.Path == "" {
+			return fmt.Errorf("path is required by the %s type", CursorStoreJSON)
+		}
+	case CursorStoreElasticsearch:
+		if c.Index == "" || c.Account == "" {
+			return fmt.Errorf("index and account are required by the %s type", CursorStoreElasticsearch)
+		}
+	case CursorStoreRegistry:
+		if c.RegistryPath == "" {
+			return fmt.Errorf("registry_path is required by the %s type", CursorStoreRegistry)
+		}
+	default:
+		return fmt.Errorf("type must be %s, %s, %s, %s or %s", CursorStoreFile, CursorStoreJSON, CursorStoreRegistry, CursorStoreElasticsearch, CursorStoreMemory)
+	}
+	return nil
+}
+
+// BackoffConfig controls how long a failed stream waits before it is
+// restarted. The delay doubles after every consecutive failure, up to Max.
+type BackoffConfig struct {
+	Init time.Duration `config:"init"`
+	Max  time.Duration `config:"max"`
+}
+
+func (c *BackoffConfig) Validate() error {
+	if c.Init <= 0 {
+		return fmt.Errorf("init must be greater than 0")
+	}
+	if c.Max < c.Init {
+		return fmt.Errorf("max can't be less than init")
+	}
+	return nil
+}
+
+// RetryConfig bounds how often, and for how long, a failed Events API request
+// is retried before the stream fails. A MaxElapsed of 0 means no limit.
+type RetryConfig struct {
+	MaxRetries int           `config:"max_retries"`
+	MaxElapsed time.Duration `config:"max_elapsed"`
+}
+
+func (c *RetryConfig) Validate() error {
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("max_retries can't be negative")
+	}
+	if c.MaxElapsed < 0 {
+		return fmt.Errorf("max_elapsed can't be negative")
+	}
+	return nil
+}
+
+// DefaultEventConfig returns the default settings of the stream with the
+// given name.
+func DefaultEventConfig(name string) EventConfig {
+	return EventConfig{
 		Enabled:         false,
 		AuthToken:       "",
-		StartingCursor:  `{ "limit": 1000, "start_time": "2020-01-01T00:00:00Z" }`,
-		CursorStateFile: "eventsapibeat_auditevents.state",
+		Limit:           api.MaxLimit,
+		CursorStateFile: fmt.Sprintf("eventsapibeat_%s.state", name),
 		SampleFrequency: 10 * time.Second,
-	},
+	}
+}
+
+// UnpackEventConfig reads the settings of the stream with the given name from
+// cfg, on top of the stream defaults. cfg may be nil.
+func UnpackEventConfig(cfg *common.Config, name string) (EventConfig, error) {
+	c := DefaultEventConfig(name)
+	if cfg == nil {
+		return c, nil
+	}
+	if err := cfg.Unpack(&c); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// CustomStreamConfig describes an Events API endpoint that is not built into
+// the beat. It is configured in the same list entry as its EventConfig.
+type CustomStreamConfig struct {
+	Name         string               `config:"name"`
+	Path         string               `config:"path"`
+	FeatureScope string               `config:"feature_scope"`
+	Fields       []FieldMappingConfig `config:"fields"`
+}
+
+func (c *CustomStreamConfig) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("name can't be empty")
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("path of %s must start with /", c.Name)
+	}
+	if c.FeatureScope == "" {
+		return fmt.Errorf("feature_scope of %s can't be empty", c.Name)
+	}
+	return nil
+}
+
+// ValidateDataStream checks that the name of the stream makes a valid data
+// stream dataset, which it is part of when data_stream is enabled. Dashes are
+// replaced and upper case letters lowered in datasets.
+func (c *CustomStreamConfig) ValidateDataStream() error {
+	if strings.ContainsAny(c.Name, invalidDataStreamChars) {
+		return fmt.Errorf("name %q is not a valid data stream dataset, it can't contain any of %s", c.Name, invalidDataStreamChars)
+	}
+	if n := len(api.ECSModule) + 1 + len(c.Name); n > maxDataStreamPart {
+		return fmt.Errorf("name %q is not a valid data stream dataset, it can't be longer than %d characters", c.Name, maxDataStreamPart-len(api.ECSModule)-1)
+	}
+	return nil
+}
+
+// FieldMappingConfig maps the value at the dotted path From of an item to the
+// dotted event field To. Type is one of keyword, long, double, boolean, date
+// or ip, the value is copied as is when it is empty.
+type FieldMappingConfig struct {
+	From string `config:"from"`
+	To   string `config:"to"`
+	Type string `config:"type"`
 }
 
 type EventConfig struct {
-	Enabled         bool          `config:"enabled"`
-	AuthToken       string        `config:"auth_token"`
+	Enabled   bool   `config:"enabled"`
+	AuthToken string `config:"auth_token"`
+	// StartFrom, EndTime and Limit make up the cursor of the first request
+	// made without a saved cursor. See ResolveStartFrom for the values of
+	// StartFrom, EndTime is an RFC 3339 time. StartTime is an alias of an
+	// absolute StartFrom.
+	StartFrom string `config:"start_from"`
+	StartTime string `config:"start_time"`
+	EndTime   string `config:"end_time"`
+	Limit     int    `config:"limit"`
+	// StartingCursor is the deprecated JSON form of the first cursor. It takes
+	// precedence over StartTime, EndTime and Limit.
 	StartingCursor  string        `config:"starting_cursor"`
 	CursorStateFile string        `config:"cursor_state_file"`
 	SampleFrequency time.Duration `config:"sample_frequency"`
+	EventsAPIURL    string        `config:"events_api_url"`
+}
+
+// Cursor returns the cursor of the first request made without a saved
+// cursor, resolving a relative start_from against now.
+func (c *EventConfig) Cursor(now time.Time) (api.Cursor, error) {
+	if c.StartingCursor != "" {
+		cursor, err := api.ParseCursor(c.StartingCursor)
+		if err != nil {
+			return cursor, fmt.Errorf("invalid starting_cursor. %w", err)
+		}
+		return cursor, nil
+	}
+
+	cursor := api.Cursor{Limit: c.Limit}
+	startFrom := c.StartFrom
+	switch {
+	case c.StartFrom != "" && c.StartTime != "":
+		return cursor, fmt.Errorf("start_from can't be combined with start_time")
+	case c.StartTime != "":
+		if _, err := time.Parse(time.RFC3339, c.StartTime); err != nil {
+			return cursor, fmt.Errorf("invalid start_time. %w", err)
+		}
+		startFrom = c.StartTime
+	case c.StartFrom == "":
+		startFrom = DefaultStartFrom
+	}
+	startTime, err := ResolveStartFrom(startFrom, now)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid start_from. %w", err)
+	}
+	cursor.StartTime = startTime
+	if c.EndTime != "" {
+		t, err := time.Parse(time.RFC3339, c.EndTime)
+		if err != nil {
+			return cursor, fmt.Errorf("invalid end_time. %w", err)
+		}
+		cursor.EndTime = &t
+	}
+	if err := cursor.Validate(); err != nil {
+		return cursor, err
+	}
+	return cursor, nil
 }
 
 func (c *EventConfig) Validate() error {
@@ -68,11 +415,85 @@ func (c *EventConfig) Validate() error {
 	if c.AuthToken == "" {
 		return fmt.Errorf("auth_token can't be empty")
 	}
-	if c.StartingCursor == "" {
-		return fmt.Errorf("starting_cursor can't be empty")
+	if _, err := c.Cursor(time.Now()); err != nil {
+		return err
 	}
 	if c.CursorStateFile == "" {
 		return fmt.Errorf("cursor_state_file can't be empty")
 	}
+	return validateEventsAPIURL(c.EventsAPIURL)
+}
+
+// Values of start_from that are not times or durations.
+const (
+	// StartFromEarliest starts from the oldest event kept by the Events API.
+	StartFromEarliest = "earliest"
+	// StartFromNow starts from the events that happen after the stream starts.
+	StartFromNow = "now"
+)
+
+// DefaultStartFrom is used when neither start_from nor start_time are set.
+const DefaultStartFrom = "2020-01-01T00:00:00Z"
+
+// ResolveStartFrom returns the start time selected by a start_from policy:
+// earliest, now, a duration before now such as 7d or 24h, or an RFC 3339
+// time. The start time is nil for earliest.
+func ResolveStartFrom(startFrom string, now time.Time) (*time.Time, error) {
+	switch startFrom {
+	case StartFromEarliest:
+		return nil, nil
+	case StartFromNow:
+		return &now, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, startFrom); err == nil {
+		return &t, nil
+	}
+
+	d, err := parseRelativeDuration(startFrom)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not earliest, now, a duration or an RFC 3339 time", startFrom)
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("duration %q must be positive", startFrom)
+	}
+	t := now.Add(-d)
+	return &t, nil
+}
+
+// parseRelativeDuration parses a time.Duration that may also use a day unit,
+// e.g. 7d or 1d12h.
+func parseRelativeDuration(s string) (time.Duration, error) {
+	var days int64
+	if i := strings.Index(s, "d"); i > 0 {
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		days, s = n, s[i+1:]
+		if s == "" {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(days)*24*time.Hour + d, nil
+}
+
+// validateEventsAPIURL checks that an events_api_url override, if any, is an
+// absolute http or https URL.
+func validateEventsAPIURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid events_api_url. %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("events_api_url must be an absolute http or https URL")
+	}
 	return nil
 }
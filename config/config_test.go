@@ -0,0 +1,118 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCustomStreamConfigValidateDataStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "reports"},
+		{name: "Item-Reports"},
+		{name: "item reports", wantErr: true},
+		{name: "reports*", wantErr: true},
+		{name: `reports\v2`, wantErr: true},
+		{name: "reports/v2", wantErr: true},
+		{name: "reports?", wantErr: true},
+		{name: `"reports"`, wantErr: true},
+		{name: "<reports>", wantErr: true},
+		{name: "reports|v2", wantErr: true},
+		{name: "reports,v2", wantErr: true},
+		{name: "reports#v2", wantErr: true},
+		{name: "reports:v2", wantErr: true},
+		{name: strings.Repeat("r", 90)},
+		{name: strings.Repeat("r", 91), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := CustomStreamConfig{Name: tt.name, Path: "/api/v1/reports", FeatureScope: "reports"}
+			err := c.ValidateDataStream()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateDataStream() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveStartFrom(t *testing.T) {
+	now := time.Date(2024, 1, 8, 12, 0, 0, 0, time.UTC)
+	at := func(t time.Time) *time.Time { return &t }
+
+	tests := []struct {
+		startFrom string
+		want      *time.Time
+		wantErr   bool
+	}{
+		{startFrom: StartFromEarliest},
+		{startFrom: StartFromNow, want: at(now)},
+		{startFrom: "2024-01-01T00:00:00Z", want: at(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))},
+		{startFrom: "2024-01-01T02:00:00+02:00", want: at(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))},
+		{startFrom: "7d", want: at(now.Add(-7 * 24 * time.Hour))},
+		{startFrom: "1d12h", want: at(now.Add(-36 * time.Hour))},
+		{startFrom: "24h", want: at(now.Add(-24 * time.Hour))},
+		{startFrom: "90m", want: at(now.Add(-90 * time.Minute))},
+		{startFrom: "0d", wantErr: true},
+		{startFrom: "0s", wantErr: true},
+		{startFrom: "-7d", wantErr: true},
+		{startFrom: "-24h", wantErr: true},
+		{startFrom: "-1d12h", wantErr: true},
+		{startFrom: "", wantErr: true},
+		{startFrom: "yesterday", wantErr: true},
+		{startFrom: "7", wantErr: true},
+		{startFrom: "1.5d", wantErr: true},
+		{startFrom: "7dh", wantErr: true},
+		{startFrom: "2024-01-01", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.startFrom, func(t *testing.T) {
+			got, err := ResolveStartFrom(tt.startFrom, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveStartFrom(%q) returned %v, want error %v", tt.startFrom, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && !got.Equal(*tt.want) {
+				t.Errorf("ResolveStartFrom(%q) = %v, want %v", tt.startFrom, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRelativeDuration(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{s: "7d", want: 7 * 24 * time.Hour},
+		{s: "1d12h", want: 36 * time.Hour},
+		{s: "0d", want: 0},
+		{s: "-2d", want: -48 * time.Hour},
+		{s: "36h", want: 36 * time.Hour},
+		{s: "1h30m", want: 90 * time.Minute},
+		{s: "d", wantErr: true},
+		{s: "xd", wantErr: true},
+		{s: "7dx", wantErr: true},
+		{s: "7", wantErr: true},
+		{s: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseRelativeDuration(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRelativeDuration(%q) returned %v, want error %v", tt.s, err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseRelativeDuration(%q) = %s, want %s", tt.s, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+// Package include registers the field definitions of the beat, from which
+// setup builds the Elasticsearch index template and the Kibana index pattern.
+package include
+
+import (
+	_ "embed"
+
+	"github.com/elastic/beats/v7/libbeat/asset"
+)
+
+//go:embed fields.yml
+var fieldsYml string
+
+func init() {
+	if err := asset.SetFields("eventsapibeat", "fields.yml", asset.BeatFieldsPri, AssetFieldsYml); err != nil {
+		panic(err)
+	}
+}
+
+// AssetFieldsYml returns fields.yml encoded as the asset registry expects it.
+func AssetFieldsYml() string {
+	encoded, err := asset.EncodeData(fieldsYml)
+	if err != nil {
+		panic(err)
+	}
+	return encoded
+}
@@ -0,0 +1,27 @@
+package store
+
+// Backend opens the cursor stores of the streams.
+type Backend interface {
+	// Open returns the cursor store of the stream name. file is the
+	// cursor_state_file of the stream, used by backends that keep a file per
+	// stream.
+	Open(name, file string) (CursorStore, error)
+	// Close releases the backend once the stores it opened are closed.
+	Close() error
+}
+
+type fileBackend struct{}
+
+// NewFileBackend returns the backend that keeps the cursors of every stream
+// in its own file, see NewCursorHistoryFileStore.
+func NewFileBackend() Backend {
+	return fileBackend{}
+}
+
+func (fileBackend) Open(_, file string) (CursorStore, error) {
+	return NewCursorHistoryFileStore(file)
+}
+
+func (fileBackend) Close() error {
+	return nil
+}
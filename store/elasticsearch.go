@@ -0,0 +1,178 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ESClient sends requests to Elasticsearch. *eslegclient.Connection
+// implements it.
+type ESClient interface {
+	Request(method, path string, pipeline string, params map[string]string, body interface{}) (int, []byte, error)
+}
+
+// ErrCursorConflict is returned when a cursor kept in Elasticsearch was
+// changed by another process since it was read.
+var ErrCursorConflict = errors.New("cursor was changed by another process")
+
+// esBackend keeps the cursors of the streams in an Elasticsearch index, one
+// document per account and stream. Documents are only replaced when they
+// have not changed since they were read, so two beats collecting the same
+// stream fail instead of overwriting each other's cursors.
+type esBackend struct {
+	client  ESClient
+	index   string
+	account string
+}
+
+type esCursor struct {
+	Account string    `json:"account"`
+	Stream  string    `json:"stream"`
+	Cursor  string    `json:"cursor"`
+	Updated time.Time `json:"updated"`
+}
+
+var esCursorMappings = map[string]interface{}{
+	"mappings": map[string]interface{}{
+		"dynamic": false,
+		"properties": map[string]interface{}{
+			"account": map[string]interface{}{"type": "keyword"},
+			"stream":  map[string]interface{}{"type": "keyword"},
+			"cursor":  map[string]interface{}{"type": "keyword", "index": false},
+			"updated": map[string]interface{}{"type": "date"},
+		},
+	},
+}
+
+// NewElasticsearchBackend returns the backend that keeps the cursors of the
+// streams of account in index, which is created if it does not exist.
+func NewElasticsearchBackend(client ESClient, index, account string) (Backend, error) {
+	status, _, err := client.Request(http.MethodHead, "/"+url.PathEscape(index), "", nil, nil)
+	switch {
+	case status == http.StatusNotFound:
+		status, body, err := client.Request(http.MethodPut, "/"+url.PathEscape(index), "", nil, esCursorMappings)
+		// Another beat may have created it in the meantime.
+		if err != nil && !(status == http.StatusBadRequest && esErrorType(body) == "resource_already_exists_exception") {
+			return nil, fmt.Errorf("failed to create cursor index %s: %w", index, err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to check cursor index %s: %w", index, err)
+	}
+
+	return &esBackend{client: client, index: index, account: account}, nil
+}
+
+func (b *esBackend) Open(name, _ string) (CursorStore, error) {
+	s := &esStore{backend: b, name: name, id: b.account + ":" + name}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the client, if it is an io.Closer.
+func (b *esBackend) Close() error {
+	if closer, ok := b.client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type esStore struct {
+	backend *esBackend
+	name    string
+	id      string
+
+	mu     sync.Mutex
+	cursor string
+	// seqNo and primaryTerm identify the version of the document that was
+	// last read or written, seqNo is -1 when there is none.
+	seqNo       int64
+	primaryTerm int64
+}
+
+func (s *esStore) path() string {
+	return "/" + url.PathEscape(s.backend.index) + "/_doc/" + url.PathEscape(s.id)
+}
+
+func (s *esStore) load() error {
+	status, body, err := s.backend.client.Request(http.MethodGet, s.path(), "", nil, nil)
+	if status == http.StatusNotFound {
+		s.seqNo = -1
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s cursor: %w", s.name, err)
+	}
+
+	var doc struct {
+		SeqNo       int64    `json:"_seq_no"`
+		PrimaryTerm int64    `json:"_primary_term"`
+		Source      esCursor `json:"_source"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return fmt.Errorf("failed to decode %s cursor: %w", s.name, err)
+	}
+	s.cursor, s.seqNo, s.primaryTerm = doc.Source.Cursor, doc.SeqNo, doc.PrimaryTerm
+	return nil
+}
+
+func (s *esStore) GetValue() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cursor, nil
+}
+
+func (s *esStore) SetValue(v string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	params := map[string]string{"op_type": "create"}
+	if s.seqNo >= 0 {
+		params = map[string]string{
+			"if_seq_no":       strconv.FormatInt(s.seqNo, 10),
+			"if_primary_term": strconv.FormatInt(s.primaryTerm, 10),
+		}
+	}
+	doc := esCursor{Account: s.backend.account, Stream: s.name, Cursor: v, Updated: time.Now().UTC()}
+	status, body, err := s.backend.client.Request(http.MethodPut, s.path(), "", params, doc)
+	if status == http.StatusConflict {
+		return fmt.Errorf("failed to save cursor: %s, with error: %w", v, ErrCursorConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save cursor: %s, with error: %w", v, err)
+	}
+
+	var result struct {
+		SeqNo       int64 `json:"_seq_no"`
+		PrimaryTerm int64 `json:"_primary_term"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to decode the response to saving cursor: %s, with error: %w", v, err)
+	}
+	s.cursor, s.seqNo, s.primaryTerm = v, result.SeqNo, result.PrimaryTerm
+	return nil
+}
+
+func (s *esStore) Close() error {
+	return nil
+}
+
+// esErrorType returns the type of the error in an Elasticsearch error
+// response.
+func esErrorType(body []byte) string {
+	var response struct {
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(body, &response)
+	return response.Error.Type
+}
@@ -0,0 +1,181 @@
+package store_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"go.1password.io/eventsapibeat/store"
+	"go.1password.io/eventsapibeat/store/storetest"
+)
+
+const testIndex = "eventsapibeat-cursors"
+
+// missingIndexClient reports that every index is missing, like a client that
+// checked for the index just before another beat created it.
+type missingIndexClient struct {
+	store.ESClient
+}
+
+func (c missingIndexClient) Request(method, path string, pipeline string, params map[string]string, body interface{}) (int, []byte, error) {
+	if method == http.MethodHead {
+		return http.StatusNotFound, nil, errors.New("404 Not Found")
+	}
+	return c.ESClient.Request(method, path, pipeline, params, body)
+}
+
+func openESStore(t *testing.T, client store.ESClient, account, name string) store.CursorStore {
+	t.Helper()
+	backend, err := store.NewElasticsearchBackend(client, testIndex, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := backend.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func savedCursor(t *testing.T, es *storetest.Elasticsearch, id string) string {
+	t.Helper()
+	source, ok := es.Document(testIndex, id)
+	if !ok {
+		t.Fatalf("document %s does not exist", id)
+	}
+	var doc struct {
+		Cursor string `json:"cursor"`
+	}
+	if err := json.Unmarshal(source, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc.Cursor
+}
+
+func TestElasticsearchBackend(t *testing.T) {
+	tests := []struct {
+		name string
+		// run saves cursors with the stores of two beats collecting the
+		// auditevents stream of the same account, and returns the error of
+		// the last save.
+		run        func(t *testing.T, a, b func() store.CursorStore) error
+		wantErr    error
+		wantCursor string
+	}{
+		{
+			name: "create",
+			run: func(t *testing.T, a, _ func() store.CursorStore) error {
+				return a().SetValue("first")
+			},
+			wantCursor: "first",
+		},
+		{
+			name: "update",
+			run: func(t *testing.T, a, _ func() store.CursorStore) error {
+				s := a()
+				for _, v := range []string{"first", "second", "third"} {
+					if err := s.SetValue(v); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			wantCursor: "third",
+		},
+		{
+			name: "update after reopening",
+			run: func(t *testing.T, a, _ func() store.CursorStore) error {
+				if err := a().SetValue("first"); err != nil {
+					return err
+				}
+				s := a()
+				if v, _ := s.GetValue(); v != "first" {
+					t.Errorf("GetValue() = %q, want %q", v, "first")
+				}
+				return s.SetValue("second")
+			},
+			wantCursor: "second",
+		},
+		{
+			name: "conflicting create",
+			run: func(t *testing.T, a, b func() store.CursorStore) error {
+				sa, sb := a(), b()
+				if err := sa.SetValue("first"); err != nil {
+					return err
+				}
+				return sb.SetValue("other")
+			},
+			wantErr:    store.ErrCursorConflict,
+			wantCursor: "first",
+		},
+		{
+			name: "conflicting update",
+			run: func(t *testing.T, a, b func() store.CursorStore) error {
+				sa := a()
+				if err := sa.SetValue("first"); err != nil {
+					return err
+				}
+				sb := b()
+				if err := sb.SetValue("other"); err != nil {
+					return err
+				}
+				return sa.SetValue("second")
+			},
+			wantErr:    store.ErrCursorConflict,
+			wantCursor: "other",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			es := storetest.NewElasticsearch()
+			defer es.Close()
+			open := func() store.CursorStore {
+				conn, err := es.Connection()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return openESStore(t, conn, "acme", "auditevents")
+			}
+
+			err := tt.run(t, open, open)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if cursor := savedCursor(t, es, "acme:auditevents"); cursor != tt.wantCursor {
+				t.Errorf("saved cursor %q, want %q", cursor, tt.wantCursor)
+			}
+		})
+	}
+}
+
+func TestNewElasticsearchBackendIndexExists(t *testing.T) {
+	es := storetest.NewElasticsearch()
+	defer es.Close()
+	conn, err := es.Connection()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		client store.ESClient
+	}{
+		{name: "create index", client: conn},
+		{name: "index exists", client: conn},
+		{name: "index created concurrently", client: missingIndexClient{conn}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openESStore(t, tt.client, "acme", tt.name)
+			if err := s.SetValue(tt.name); err != nil {
+				t.Fatal(err)
+			}
+			if cursor := savedCursor(t, es, "acme:"+tt.name); cursor != tt.name {
+				t.Errorf("saved cursor %q, want %q", cursor, tt.name)
+			}
+		})
+	}
+}
@@ -3,9 +3,14 @@ package store
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type CursorStore interface {
@@ -14,86 +19,157 @@ type CursorStore interface {
 	Close() error
 }
 
+// Record is a cursor saved in a cursor file.
+type Record struct {
+	// Time is when the cursor was saved. It is zero for cursors saved by
+	// releases that did not record it.
+	Time  time.Time
+	Value string
+}
+
 const (
 	CursorLength = 200 // this is a rough estimate
+
+	// maxFileSize is the size above which a cursor file is rolled, keeping its
+	// last rolledRecords records.
+	maxFileSize   = CursorLength * 1000
+	rolledRecords = 100
+
+	// tailSize is the size of the end of a cursor file read to find the latest
+	// record. It is doubled until a valid record is found.
+	tailSize = CursorLength * 16
+
+	// fileHeader is the first line of the cursor files whose records are all
+	// checksummed. Files without it were written by earlier releases, they
+	// are rewritten with checksums when opened.
+	fileHeader = "# eventsapibeat cursors v2"
 )
 
+// historyFileStore appends every cursor to a file, one checksummed record per
+// line after a header line, and syncs the file after each write. A torn or
+// corrupted last record, left by a crash, is skipped and the previous valid
+// cursor is used.
 type historyFileStore struct {
-	file *os.File
+	name   string
+	file   *os.File
+	lock   *lockFile
+	size   int64
+	latest Record
 }
 
 func NewCursorHistoryFileStore(name string) (CursorStore, error) {
-
-	file, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	lock, err := acquireLock(name)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open cursor file: %w", err)
+		return nil, err
 	}
 
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get cursor file info: %w", err)
+	f := &historyFileStore{name: name, lock: lock}
+	if err := f.open(); err != nil {
+		_ = lock.release()
+		return nil, err
 	}
 
-	if stat.Size() > CursorLength*1000 {
-		err := rollFile(file, CursorLength*100)
-		if err != nil {
+	if f.size > maxFileSize {
+		if err := f.roll(); err != nil {
+			f.file.Close()
+			_ = lock.release()
 			return nil, fmt.Errorf("failed to roll file: %w", err)
 		}
 	}
 
-	return &historyFileStore{file: file}, nil
+	return f, nil
 }
 
-// GetValue reads one character at a time from the end of a file, backtracking
-// until it finds a newline character (note, newline characters are different
-// depending on the operating system). If the last line of the file is the newline
-// character, it is skipped, and looks for the next instance of the newline character.
-func (f *historyFileStore) GetValue() (string, error) {
-	stat, err := f.file.Stat()
+// open opens the cursor file, drops a torn last line and loads the latest
+// valid record from the end of the file. A new file gets a header, and a file
+// written by an earlier release is rewritten with checksums first.
+func (f *historyFileStore) open() error {
+	file, err := os.OpenFile(f.name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("failed to open cursor file: %w", err)
 	}
 
-	var seekStart int64 = -1
-	filesize := stat.Size()
-	readChar := make([]byte, 1)
-	lastLine := ""
-	for {
-		if filesize < -seekStart {
-			break
-		}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to get cursor file info: %w", err)
+	}
 
-		_, err := f.file.Seek(seekStart, io.SeekEnd)
-		if err != nil {
-			return "", err
+	if stat.Size() == 0 {
+		if _, err := file.WriteString(fileHeader + "\n"); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write cursor file header: %w", err)
 		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write cursor file header: %w", err)
+		}
+		f.file, f.size, f.latest = file, int64(len(fileHeader)+1), Record{}
+		return nil
+	}
 
-		_, err = f.file.Read(readChar)
+	header := make([]byte, len(fileHeader)+1)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header) != fileHeader+"\n" {
+		records, err := readRecords(file)
+		file.Close()
 		if err != nil {
-			return "", err
+			return err
 		}
-
-		if (readChar[0] == '\n' || readChar[0] == '\r') && seekStart != -1 {
-			break
+		f.file = nil
+		if err := f.rewrite(records); err != nil {
+			return fmt.Errorf("failed to add checksums to cursor file: %w", err)
 		}
-		lastLine = fmt.Sprintf("%s%s", string(readChar), lastLine)
+		return f.open()
+	}
 
-		seekStart--
+	latest, end, err := lastRecord(file, stat.Size())
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to read cursor file: %w", err)
 	}
-	return lastLine, nil
+	if end != stat.Size() {
+		if err := file.Truncate(end); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to remove torn cursor record: %w", err)
+		}
+	}
+
+	f.file, f.size, f.latest = file, end, latest
+	return nil
+}
+
+// GetValue returns the latest valid cursor, or an empty string if none was
+// saved.
+func (f *historyFileStore) GetValue() (string, error) {
+	return f.latest.Value, nil
 }
 
 func (f *historyFileStore) SetValue(v string) error {
-	n, err := fmt.Fprintln(f.file, v)
+	if strings.ContainsAny(v, "\r\n") {
+		return fmt.Errorf("failed to save cursor: %s, it contains a line break", v)
+	}
+
+	r := Record{Time: time.Now(), Value: v}
+	line := formatRecord(r) + "\n"
+	n, err := f.file.WriteString(line)
+	if err == nil {
+		err = f.file.Sync()
+	}
 	if err != nil {
-		if n == 0 {
-			err = fmt.Errorf("failed to save cursor: %s, with error: %s", v, err)
-		} else if n != len(v) {
-			err = fmt.Errorf("corrupted state, we saved %d bytes of original cursor: %s, with error: %s", n, v, err)
-		} else {
-			err = fmt.Errorf("something went wrong when saving cursor: %s, with error: %s", v, err)
+		// Drop whatever part of the record was written, so that the next
+		// record starts on a line of its own.
+		if n > 0 {
+			_ = f.file.Truncate(f.size)
+		}
+		return fmt.Errorf("failed to save cursor: %s, with error: %w", v, err)
+	}
+	f.size += int64(n)
+	f.latest = r
+
+	if f.size > maxFileSize {
+		if err := f.roll(); err != nil {
+			return fmt.Errorf("failed to roll file: %w", err)
 		}
-		return err
 	}
 	return nil
 }
@@ -101,48 +177,234 @@ func (f *historyFileStore) SetValue(v string) error {
 func (f *historyFileStore) Close() error {
 	err := f.file.Close()
 	if err != nil {
+		_ = f.lock.release()
 		return fmt.Errorf("failed to close cursor file. %w", err)
 	}
 
-	return nil
+	return f.lock.release()
 }
 
-func rollFile(file *os.File, length int64) error {
-	if file == nil {
-		return fmt.Errorf("received a nil file")
+// roll replaces the cursor file with one holding its last rolledRecords
+// records.
+func (f *historyFileStore) roll() error {
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek file: %w", err)
 	}
-
-	saveBytes := make([]byte, length)
-	var seekStart int64 = -length
-	_, err := file.Seek(seekStart, io.SeekEnd)
+	records, err := readRecords(f.file)
 	if err != nil {
-		return fmt.Errorf("failed to seek file: %w", err)
+		return err
+	}
+	if len(records) > rolledRecords {
+		records = records[len(records)-rolledRecords:]
 	}
 
-	_, err = file.Read(saveBytes)
-	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
+	if err := f.rewrite(records); err != nil {
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
 	}
+	return f.open()
+}
 
-	bytesReader := bytes.NewReader(saveBytes)
-	bufReader := bufio.NewReader(bytesReader)
-	bufReader.ReadLine() // trim first line
+// rewrite replaces the cursor file with one holding records, closing f.file if
+// it is open. The records are written to a temporary file which is then
+// renamed over the cursor file, so that a crash leaves either the old or the
+// new file.
+func (f *historyFileStore) rewrite(records []Record) error {
+	var b bytes.Buffer
+	b.WriteString(fileHeader + "\n")
+	for _, r := range records {
+		b.WriteString(formatRecord(r))
+		b.WriteByte('\n')
+	}
+	if err := writeFileSync(f.name+".tmp", b.Bytes()); err != nil {
+		return err
+	}
 
-	err = file.Truncate(0)
-	if err != nil {
-		return fmt.Errorf("failed to truncate file: %w", err)
+	// Windows can't rename over an open file.
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			return fmt.Errorf("failed to close cursor file: %w", err)
+		}
+		f.file = nil
+	}
+	if err := os.Rename(f.name+".tmp", f.name); err != nil {
+		_ = os.Remove(f.name + ".tmp")
+		return fmt.Errorf("failed to replace cursor file: %w", err)
 	}
+	syncDir(filepath.Dir(f.name))
+	return nil
+}
 
-	_, err = file.Seek(0, 0)
+// ReadHistory returns every valid cursor saved in the cursor file name, oldest
+// first. It does not lock the file.
+func ReadHistory(name string) ([]Record, error) {
+	file, err := os.Open(name)
 	if err != nil {
-		return fmt.Errorf("failed to seek to beginning of file: %w", err)
+		return nil, fmt.Errorf("failed to open cursor file: %w", err)
 	}
+	defer file.Close()
 
-	_, err = bufReader.WriteTo(file)
-	if err != nil {
-		return fmt.Errorf("failed to write to file: %w", err)
+	return readRecords(file)
+}
+
+// readRecords returns the valid records read from r, skipping corrupted ones
+// and a torn last line. Records without a checksum are only accepted when r
+// does not start with the header.
+func readRecords(r io.Reader) ([]Record, error) {
+	var records []Record
+	reader := bufio.NewReader(r)
+	legacy := true
+	for first := true; ; first = false {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// The last line is torn unless it ends with a line break.
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cursor file: %w", err)
+		}
+		if first && line == fileHeader+"\n" {
+			legacy = false
+			continue
+		}
+		if record, ok := parseRecord(line, legacy); ok {
+			records = append(records, record)
+		}
 	}
+}
 
+// lastRecord returns the latest valid record of a cursor file of the given
+// size, and the end of its last complete line. Only the end of the file is
+// read unless it holds no valid record. The file must start with the header.
+func lastRecord(file *os.File, size int64) (Record, int64, error) {
+	end := int64(-1)
+	for n := int64(tailSize); ; n *= 2 {
+		if n > size {
+			n = size
+		}
+		b := make([]byte, n)
+		if _, err := file.ReadAt(b, size-n); err != nil && !errors.Is(err, io.EOF) {
+			return Record{}, 0, err
+		}
+
+		// Drop the torn last line, if any, and the first line when it may
+		// have started before the part that was read.
+		last := bytes.LastIndexByte(b, '\n')
+		if end < 0 && (last >= 0 || n == size) {
+			end = size - n + int64(last) + 1
+		}
+		lines := bytes.Split(b[:last+1], []byte("\n"))
+		first := 0
+		if n < size {
+			first = 1
+		}
+		for i := len(lines) - 1; i >= first; i-- {
+			if r, ok := parseRecord(string(lines[i]), false); ok {
+				return r, end, nil
+			}
+		}
+
+		if n == size {
+			return Record{}, end, nil
+		}
+	}
+}
+
+// formatRecord returns the line of a record: a checksum, the time it was
+// saved and the cursor, separated by tabs. Cursors are JSON documents, which
+// never contain a raw tab.
+func formatRecord(r Record) string {
+	body := r.Time.UTC().Format(time.RFC3339Nano) + "\t" + r.Value
+	return fmt.Sprintf("%08x\t%s", crc32.ChecksumIEEE([]byte(body)), body)
+}
+
+// parseRecord parses a line written by formatRecord or, when legacy is true, a
+// line written by earlier releases, without a checksum. It reports whether the
+// line holds a valid record.
+func parseRecord(line string, legacy bool) (Record, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return Record{}, false
+	}
+
+	if len(line) > 9 && line[8] == '\t' && isHex(line[:8]) {
+		body := line[9:]
+		if fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(body))) != line[:8] {
+			return Record{}, false
+		}
+		i := strings.IndexByte(body, '\t')
+		if i < 0 {
+			return Record{}, false
+		}
+		t, err := time.Parse(time.RFC3339Nano, body[:i])
+		if err != nil {
+			return Record{}, false
+		}
+		return Record{Time: t, Value: body[i+1:]}, true
+	}
+	if !legacy {
+		return Record{}, false
+	}
+
+	if i := strings.IndexByte(line, '\t'); i > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, line[:i]); err == nil {
+			return Record{Time: t, Value: line[i+1:]}, true
+		}
+	}
+	return Record{Value: line}, true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteFile replaces the content of the file name with data, atomically and
+// durably: data is written to a temporary file that is synced, then renamed.
+func WriteFile(name string, data []byte) error {
+	if err := writeFileSync(name+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", name+".tmp", err)
+	}
+	syncDir(filepath.Dir(name))
 	return nil
+}
 
+// writeFileSync writes data to the file name and syncs it to disk.
+func writeFileSync(name string, data []byte) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync %s: %w", name, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", name, err)
+	}
+	return nil
+}
+
+// syncDir syncs a directory so that a rename in it survives a crash. It is a
+// best effort, directories can't be synced on every platform.
+func syncDir(name string) {
+	dir, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	_ = dir.Sync()
+	dir.Close()
 }
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testRecords returns n records of the cursors {"cursor":"1"} to
+// {"cursor":"n"}, saved a second apart.
+func testRecords(n int) []Record {
+	records := make([]Record, n)
+	for i := range records {
+		records[i] = Record{Time: testTime.Add(time.Duration(i) * time.Second), Value: fmt.Sprintf(`{"cursor":"%d"}`, i+1)}
+	}
+	return records
+}
+
+// recordLines returns the lines of records in a cursor file.
+func recordLines(records ...Record) string {
+	var b strings.Builder
+	for _, r := range records {
+		b.WriteString(formatRecord(r) + "\n")
+	}
+	return b.String()
+}
+
+// corrupt returns the line of r with a cursor that does not match its
+// checksum.
+func corrupt(r Record) string {
+	return strings.Replace(formatRecord(r), "cursor", "cursos", 1) + "\n"
+}
+
+func TestHistoryFileStoreOpen(t *testing.T) {
+	r := testRecords(3)
+	// garbage is a record with a bad checksum, repeated over more than twice
+	// the part of the file read to find the latest record.
+	garbage := strings.Repeat(corrupt(r[1]), 2*tailSize/len(corrupt(r[1]))+1)
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		// wantHistory is the valid records left in the file, once opened.
+		wantHistory []Record
+		// wantContent is the content of the file once opened, if not empty.
+		wantContent string
+	}{
+		{
+			name:        "empty",
+			wantContent: fileHeader + "\n",
+		},
+		{
+			name:        "valid",
+			content:     fileHeader + "\n" + recordLines(r...),
+			want:        r[2].Value,
+			wantHistory: r,
+		},
+		{
+			name:        "torn last record",
+			content:     fileHeader + "\n" + recordLines(r[0], r[1]) + formatRecord(r[2])[:20],
+			want:        r[1].Value,
+			wantHistory: r[:2],
+			wantContent: fileHeader + "\n" + recordLines(r[0], r[1]),
+		},
+		{
+			name:        "bad checksum in the middle",
+			content:     fileHeader + "\n" + recordLines(r[0]) + corrupt(r[1]) + recordLines(r[2]),
+			want:        r[2].Value,
+			wantHistory: []Record{r[0], r[2]},
+		},
+		{
+			name:        "bad checksum at the end",
+			content:     fileHeader + "\n" + recordLines(r[0], r[1]) + corrupt(r[2]),
+			want:        r[1].Value,
+			wantHistory: r[:2],
+		},
+		{
+			name:        "last valid record before the tail",
+			content:     fileHeader + "\n" + recordLines(r[0]) + garbage,
+			want:        r[0].Value,
+			wantHistory: r[:1],
+		},
+		{
+			name: "legacy",
+			content: r[0].Value + "\n" +
+				r[1].Time.Format(time.RFC3339Nano) + "\t" + r[1].Value + "\n",
+			want:        r[1].Value,
+			wantHistory: []Record{{Value: r[0].Value}, r[1]},
+			wantContent: fileHeader + "\n" + recordLines(Record{Value: r[0].Value}, r[1]),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "cursor")
+			if tt.content != "" {
+				if err := os.WriteFile(name, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s, err := NewCursorHistoryFileStore(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			if v, err := s.GetValue(); err != nil || v != tt.want {
+				t.Errorf("GetValue() = %q, %v, want %q", v, err, tt.want)
+			}
+			if tt.wantContent != "" {
+				content, err := os.ReadFile(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(content) != tt.wantContent {
+					t.Errorf("file content is %q, want %q", content, tt.wantContent)
+				}
+			}
+			history, err := ReadHistory(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalRecords(history, tt.wantHistory) {
+				t.Errorf("ReadHistory() = %v, want %v", history, tt.wantHistory)
+			}
+
+			// The next record starts on a line of its own.
+			if err := s.SetValue(`{"cursor":"next"}`); err != nil {
+				t.Fatal(err)
+			}
+			history, err = ReadHistory(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(history); n != len(tt.wantHistory)+1 || history[n-1].Value != `{"cursor":"next"}` {
+				t.Errorf("ReadHistory() = %v after SetValue, want %v and the new cursor", history, tt.wantHistory)
+			}
+		})
+	}
+}
+
+func TestHistoryFileStoreRoll(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "cursor")
+	var records []Record
+	size := len(fileHeader) + 1
+	for i := 0; size <= maxFileSize; i++ {
+		r := Record{Time: testTime.Add(time.Duration(i) * time.Second), Value: fmt.Sprintf(`{"cursor":"%0150d"}`, i)}
+		records = append(records, r)
+		size += len(formatRecord(r)) + 1
+	}
+	if err := os.WriteFile(name, []byte(fileHeader+"\n"+recordLines(records...)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewCursorHistoryFileStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	history, err := ReadHistory(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := records[len(records)-rolledRecords:]; !equalRecords(history, want) {
+		t.Errorf("rolled file holds %d records, want the last %d of %d", len(history), rolledRecords, len(records))
+	}
+	if v, _ := s.GetValue(); v != records[len(records)-1].Value {
+		t.Errorf("GetValue() = %q, want %q", v, records[len(records)-1].Value)
+	}
+	stat, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() > maxFileSize {
+		t.Errorf("rolled file size is %d, want at most %d", stat.Size(), maxFileSize)
+	}
+}
+
+func equalRecords(a, b []Record) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Time.Equal(b[i].Time) || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// jsonBackend keeps the cursors of all the streams in a single JSON document,
+// an object keyed by stream name. The document is locked like a cursor file,
+// and is replaced by writing a temporary file then renaming it on every save.
+type jsonBackend struct {
+	mu      sync.Mutex
+	name    string
+	lock    *lockFile
+	cursors map[string]jsonCursor
+}
+
+type jsonCursor struct {
+	Cursor string    `json:"cursor"`
+	Saved  time.Time `json:"saved"`
+}
+
+// NewJSONBackend returns the backend that keeps the cursors of all the streams
+// in the JSON document name, which is created if it does not exist.
+func NewJSONBackend(name string) (Backend, error) {
+	lock, err := acquireLock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &jsonBackend{name: name, lock: lock, cursors: map[string]jsonCursor{}}
+	data, err := os.ReadFile(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		_ = lock.release()
+		return nil, fmt.Errorf("failed to read cursor file: %w", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &b.cursors); err != nil {
+			_ = lock.release()
+			return nil, fmt.Errorf("failed to decode cursor file %s: %w", name, err)
+		}
+	}
+	return b, nil
+}
+
+func (b *jsonBackend) Open(name, _ string) (CursorStore, error) {
+	return &jsonStore{backend: b, name: name}, nil
+}
+
+func (b *jsonBackend) Close() error {
+	return b.lock.release()
+}
+
+func (b *jsonBackend) get(name string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cursors[name].Cursor
+}
+
+func (b *jsonBackend) set(name, v string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	previous, existed := b.cursors[name]
+	b.cursors[name] = jsonCursor{Cursor: v, Saved: time.Now().UTC()}
+	data, err := json.MarshalIndent(b.cursors, "", "  ")
+	if err == nil {
+		err = writeFileSync(b.name+".tmp", append(data, '\n'))
+	}
+	if err == nil {
+		err = os.Rename(b.name+".tmp", b.name)
+	}
+	if err != nil {
+		if existed {
+			b.cursors[name] = previous
+		} else {
+			delete(b.cursors, name)
+		}
+		return fmt.Errorf("failed to save cursor: %s, with error: %w", v, err)
+	}
+	syncDir(filepath.Dir(b.name))
+	return nil
+}
+
+type jsonStore struct {
+	backend *jsonBackend
+	name    string
+}
+
+func (s *jsonStore) GetValue() (string, error) {
+	return s.backend.get(s.name), nil
+}
+
+func (s *jsonStore) SetValue(v string) error {
+	return s.backend.set(s.name, v)
+}
+
+func (s *jsonStore) Close() error {
+	return nil
+}
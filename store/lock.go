@@ -0,0 +1,164 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LockOwner identifies the process that holds a cursor file.
+type LockOwner struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname,omitempty"`
+	Since    time.Time `json:"since,omitempty"`
+}
+
+func (o LockOwner) String() string {
+	s := fmt.Sprintf("process %d", o.PID)
+	if o.Hostname != "" {
+		s += " on " + o.Hostname
+	}
+	if !o.Since.IsZero() {
+		s += " since " + o.Since.Local().Format(time.RFC3339)
+	}
+	return s
+}
+
+// LockedError is returned when a cursor file is in use by another process.
+type LockedError struct {
+	Name  string
+	Owner LockOwner
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("cursor file %s is in use by %s", e.Name, e.Owner)
+}
+
+// lockFile holds an exclusive advisory lock on the lock file of a cursor file,
+// and records the owner of the lock in it. A separate file is locked because
+// rolling replaces the cursor file. Locks are released by the operating system
+// when their process exits, so a lock file left behind by a process that
+// crashed is stale and is taken over.
+type lockFile struct {
+	name string
+	file *os.File
+}
+
+func lockFileName(name string) string {
+	return name + ".lock"
+}
+
+// Holder returns the owner of the cursor file name, if it is held by a process
+// other than this one. Lock files left behind by processes of this host that
+// are no longer running are ignored.
+func Holder(name string) (LockOwner, bool) {
+	owner, err := readLockOwner(lockFileName(name))
+	if err != nil || owner.PID <= 0 {
+		return owner, false
+	}
+
+	hostname, _ := os.Hostname()
+	if owner.Hostname == "" || owner.Hostname == hostname {
+		if owner.PID == os.Getpid() || !processAlive(owner.PID) {
+			return owner, false
+		}
+	}
+	return owner, true
+}
+
+// acquireLock locks the cursor file name for this process, or fails with a
+// LockedError if another process holds it.
+func acquireLock(name string) (*lockFile, error) {
+	l := &lockFile{name: lockFileName(name)}
+
+	// The lock file is removed when the lock is released, so the lock may be
+	// taken on a file that was just removed. Retry until the locked file is
+	// the one at l.name.
+	for attempt := 0; ; attempt++ {
+		file, err := os.OpenFile(l.name, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open cursor lock file: %w", err)
+		}
+
+		locked, err := tryLock(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock cursor file: %w", err)
+		}
+		if !locked {
+			file.Close()
+			owner, _ := readLockOwner(l.name)
+			return nil, &LockedError{Name: name, Owner: owner}
+		}
+
+		if current, err := os.Stat(l.name); err == nil {
+			if opened, err := file.Stat(); err == nil && os.SameFile(current, opened) {
+				l.file = file
+				break
+			}
+		}
+		file.Close()
+		if attempt == 2 {
+			return nil, fmt.Errorf("failed to lock cursor file: %s keeps being replaced", l.name)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	owner := LockOwner{PID: os.Getpid(), Hostname: hostname, Since: time.Now().UTC()}
+	if err := l.writeOwner(owner); err != nil {
+		_ = l.release()
+		return nil, err
+	}
+	return l, nil
+}
+
+// writeOwner replaces the content of the lock file, possibly the owner of a
+// stale lock, with owner.
+func (l *lockFile) writeOwner(owner LockOwner) error {
+	b, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to write cursor lock file: %w", err)
+	}
+	if _, err := l.file.WriteAt(append(b, '\n'), 0); err != nil {
+		return fmt.Errorf("failed to write cursor lock file: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to write cursor lock file: %w", err)
+	}
+	return nil
+}
+
+// readLockOwner reads the owner recorded in a lock file, or the PID written by
+// earlier releases.
+func readLockOwner(name string) (LockOwner, error) {
+	var owner LockOwner
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return owner, err
+	}
+
+	s := strings.TrimSpace(string(b))
+	if pid, err := strconv.Atoi(s); err == nil {
+		owner.PID = pid
+		return owner, nil
+	}
+	if err := json.Unmarshal([]byte(s), &owner); err != nil {
+		return owner, fmt.Errorf("invalid cursor lock file %s. %w", name, err)
+	}
+	return owner, nil
+}
+
+// remove removes the lock file, which may already be gone.
+func (l *lockFile) remove() error {
+	if err := os.Remove(l.name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove cursor lock file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package store_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"go.1password.io/eventsapibeat/store"
+)
+
+func TestCursorFileLock(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "cursor")
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.NewCursorHistoryFileStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.NewCursorHistoryFileStore(name)
+	var locked *store.LockedError
+	if !errors.As(err, &locked) {
+		t.Fatalf("opening a held cursor file returned %v, want a LockedError", err)
+	}
+	if locked.Owner.PID != os.Getpid() || locked.Owner.Hostname != hostname {
+		t.Errorf("cursor file is held by %s, want process %d on %s", locked.Owner, os.Getpid(), hostname)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name + ".lock"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock file left behind after Close: %v", err)
+	}
+	s, err = store.NewCursorHistoryFileStore(name)
+	if err != nil {
+		t.Fatalf("opening a released cursor file returned %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCursorFileStaleLock(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "cursor")
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock file of a process that exited without releasing it.
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	stale := store.LockOwner{PID: exited.ProcessState.Pid(), Hostname: hostname}
+	b, err := json.Marshal(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name+".lock", b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if owner, held := store.Holder(name); held {
+		t.Errorf("Holder() reports the cursor file held by %s, want the stale lock ignored", owner)
+	}
+
+	s, err := store.NewCursorHistoryFileStore(name)
+	if err != nil {
+		t.Fatalf("opening a cursor file with a stale lock returned %v", err)
+	}
+	defer s.Close()
+
+	b, err = os.ReadFile(name + ".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var owner store.LockOwner
+	if err := json.Unmarshal(b, &owner); err != nil {
+		t.Fatal(err)
+	}
+	if owner.PID != os.Getpid() {
+		t.Errorf("lock file records process %d, want %d", owner.PID, os.Getpid())
+	}
+}
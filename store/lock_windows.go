@@ -0,0 +1,49 @@
+//go:build windows
+
+package store
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+func processAlive(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(h)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	// STILL_ACTIVE
+	return code == 259
+}
+
+// lockOffset is where the locked byte of a lock file is. Locked ranges can't
+// be read by other processes, so it is far past the recorded owner.
+const lockOffset = 1 << 32
+
+// tryLock takes an exclusive lock on file, without waiting. It reports
+// whether the lock was taken.
+func tryLock(file *os.File) (bool, error) {
+	overlapped := windows.Overlapped{OffsetHigh: lockOffset >> 32}
+	err := windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// release closes the lock file, which releases the lock, then removes it.
+// Windows can't remove open files, and fails to remove it if another process
+// opened it in the meantime.
+func (l *lockFile) release() error {
+	err := l.file.Close()
+	_ = l.remove()
+	return err
+}
@@ -0,0 +1,50 @@
+package store
+
+import "sync"
+
+// MemoryBackend keeps the cursors of the streams in memory, they are lost when
+// the process exits. It is meant for tests.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	cursors map[string]string
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{cursors: map[string]string{}}
+}
+
+func (b *MemoryBackend) Open(name, _ string) (CursorStore, error) {
+	return &memoryStore{backend: b, name: name}, nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
+
+// Cursor returns the cursor saved for the stream name, or an empty string if
+// none was saved.
+func (b *MemoryBackend) Cursor(name string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cursors[name]
+}
+
+type memoryStore struct {
+	backend *MemoryBackend
+	name    string
+}
+
+func (s *memoryStore) GetValue() (string, error) {
+	return s.backend.Cursor(s.name), nil
+}
+
+func (s *memoryStore) SetValue(v string) error {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	s.backend.cursors[s.name] = v
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
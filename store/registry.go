@@ -0,0 +1,89 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/statestore"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend/memlog"
+)
+
+// registryStoreName is the store of the registry that holds the cursors.
+const registryStoreName = "eventsapibeat"
+
+// registryBackend keeps the cursors of the streams in a libbeat registry, the
+// statestore used by Filebeat, under a key per stream. The registry logs every
+// change to disk and checkpoints its state from time to time.
+type registryBackend struct {
+	registry *statestore.Registry
+	store    *statestore.Store
+}
+
+type registryCursor struct {
+	Cursor  string `struct:"cursor"`
+	Updated int64  `struct:"updated"`
+}
+
+// NewRegistryBackend returns the backend that keeps the cursors of the
+// streams in the registry in the directory root, which is created if it does
+// not exist.
+func NewRegistryBackend(log *logp.Logger, root string) (Backend, error) {
+	backend, err := memlog.New(log, memlog.Settings{Root: root})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open registry %s: %w", root, err)
+	}
+
+	registry := statestore.NewRegistry(backend)
+	store, err := registry.Get(registryStoreName)
+	if err != nil {
+		registry.Close()
+		return nil, fmt.Errorf("failed to open registry %s: %w", root, err)
+	}
+	return &registryBackend{registry: registry, store: store}, nil
+}
+
+func (b *registryBackend) Open(name, _ string) (CursorStore, error) {
+	return &registryStore{store: b.store, key: "cursor::" + name}, nil
+}
+
+func (b *registryBackend) Close() error {
+	err := b.store.Close()
+	if closeErr := b.registry.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to close registry: %w", err)
+	}
+	return nil
+}
+
+type registryStore struct {
+	store *statestore.Store
+	key   string
+}
+
+func (s *registryStore) GetValue() (string, error) {
+	has, err := s.store.Has(s.key)
+	if err != nil || !has {
+		return "", err
+	}
+
+	var c registryCursor
+	if err := s.store.Get(s.key, &c); err != nil {
+		return "", fmt.Errorf("failed to read cursor: %w", err)
+	}
+	return c.Cursor, nil
+}
+
+func (s *registryStore) SetValue(v string) error {
+	c := registryCursor{Cursor: v, Updated: time.Now().UnixMilli()}
+	if err := s.store.Set(s.key, c); err != nil {
+		return fmt.Errorf("failed to save cursor: %s, with error: %w", v, err)
+	}
+	return nil
+}
+
+func (s *registryStore) Close() error {
+	return nil
+}
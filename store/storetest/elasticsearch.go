@@ -0,0 +1,185 @@
+// Package storetest provides an in-process stand-in for the parts of
+// Elasticsearch used by the elasticsearch cursor store.
+package storetest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/esleg/eslegclient"
+)
+
+// Elasticsearch is a fake Elasticsearch. It serves the root endpoint, index
+// creation and the single document get and index APIs, including op_type=create
+// and optimistic concurrency control with if_seq_no and if_primary_term.
+type Elasticsearch struct {
+	URL string
+
+	server *httptest.Server
+
+	mu          sync.Mutex
+	indices     map[string]map[string]*fakeDocument
+	seqNo       int64
+	primaryTerm int64
+	requests    int
+}
+
+type fakeDocument struct {
+	seqNo  int64
+	source json.RawMessage
+}
+
+// NewElasticsearch starts a fake Elasticsearch. Call Close when done.
+func NewElasticsearch() *Elasticsearch {
+	es := &Elasticsearch{
+		indices:     map[string]map[string]*fakeDocument{},
+		primaryTerm: 1,
+	}
+	es.server = httptest.NewServer(http.HandlerFunc(es.serveHTTP))
+	es.URL = es.server.URL
+	return es
+}
+
+// Close shuts the server down.
+func (es *Elasticsearch) Close() {
+	es.server.Close()
+}
+
+// Connection returns a connection to the server, as used by the beat.
+func (es *Elasticsearch) Connection() (*eslegclient.Connection, error) {
+	return eslegclient.NewConnection(eslegclient.ConnectionSettings{URL: es.URL})
+}
+
+// Document returns the source of the document id of index.
+func (es *Elasticsearch) Document(index, id string) (json.RawMessage, bool) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	doc, ok := es.indices[index][id]
+	if !ok {
+		return nil, false
+	}
+	return doc.source, true
+}
+
+// Requests returns the number of requests served.
+func (es *Elasticsearch) Requests() int {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.requests
+}
+
+func (es *Elasticsearch) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.requests++
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"version": map[string]interface{}{"number": "7.17.22"},
+		})
+	case len(parts) == 1:
+		es.serveIndex(w, r, parts[0])
+	case len(parts) == 3 && parts[1] == "_doc":
+		es.serveDocument(w, r, parts[0], parts[2])
+	default:
+		writeError(w, http.StatusBadRequest, "illegal_argument_exception", "unsupported request "+r.URL.Path)
+	}
+}
+
+func (es *Elasticsearch) serveIndex(w http.ResponseWriter, r *http.Request, index string) {
+	_, exists := es.indices[index]
+	switch r.Method {
+	case http.MethodHead:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		if exists {
+			writeError(w, http.StatusBadRequest, "resource_already_exists_exception", "index ["+index+"] already exists")
+			return
+		}
+		es.indices[index] = map[string]*fakeDocument{}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"acknowledged": true, "index": index})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "illegal_argument_exception", "unsupported method "+r.Method)
+	}
+}
+
+func (es *Elasticsearch) serveDocument(w http.ResponseWriter, r *http.Request, index, id string) {
+	docs, exists := es.indices[index]
+	if !exists {
+		if r.Method != http.MethodPut {
+			writeError(w, http.StatusNotFound, "index_not_found_exception", "no such index ["+index+"]")
+			return
+		}
+		docs = map[string]*fakeDocument{}
+		es.indices[index] = docs
+	}
+	doc := docs[id]
+
+	switch r.Method {
+	case http.MethodGet:
+		if doc == nil {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"_index": index, "_id": id, "found": false})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"_index": index, "_id": id, "found": true,
+			"_seq_no": doc.seqNo, "_primary_term": es.primaryTerm, "_source": doc.source,
+		})
+	case http.MethodPut, http.MethodPost:
+		query := r.URL.Query()
+		if query.Get("op_type") == "create" && doc != nil {
+			writeError(w, http.StatusConflict, "version_conflict_engine_exception", "["+id+"]: document already exists")
+			return
+		}
+		if v := query.Get("if_seq_no"); v != "" {
+			seqNo, _ := strconv.ParseInt(v, 10, 64)
+			primaryTerm, _ := strconv.ParseInt(query.Get("if_primary_term"), 10, 64)
+			if doc == nil || doc.seqNo != seqNo || es.primaryTerm != primaryTerm {
+				writeError(w, http.StatusConflict, "version_conflict_engine_exception", "["+id+"]: version conflict")
+				return
+			}
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil || !json.Valid(body) {
+			writeError(w, http.StatusBadRequest, "mapper_parsing_exception", "failed to parse")
+			return
+		}
+		result, status := "updated", http.StatusOK
+		if doc == nil {
+			result, status = "created", http.StatusCreated
+		}
+		docs[id] = &fakeDocument{seqNo: es.seqNo, source: body}
+		es.seqNo++
+		writeJSON(w, status, map[string]interface{}{
+			"_index": index, "_id": id, "result": result,
+			"_seq_no": docs[id].seqNo, "_primary_term": es.primaryTerm,
+		})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "illegal_argument_exception", "unsupported method "+r.Method)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, errorType, reason string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error":  map[string]interface{}{"type": errorType, "reason": reason},
+		"status": status,
+	})
+}
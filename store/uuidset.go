@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UUIDSet remembers the UUIDs added in the last window, up to max of them,
+// dropping the oldest first. The window is measured from the time the UUIDs
+// were added, whatever the time of the events they identify. It is kept in a file that new UUIDs are appended
+// to, one per line with the time they were added, and that is compacted when
+// the set is opened and once it holds twice as many lines as the set. The file
+// is locked like a cursor file.
+type UUIDSet struct {
+	name   string
+	window time.Duration
+	max    int
+	lock   *lockFile
+
+	mu      sync.Mutex
+	file    *os.File
+	added   map[string]time.Time
+	entries []uuidEntry
+	lines   int
+}
+
+type uuidEntry struct {
+	uuid  string
+	added time.Time
+}
+
+// OpenUUIDSet opens the set kept in the file name, which is created if it does
+// not exist.
+func OpenUUIDSet(name string, window time.Duration, max int) (*UUIDSet, error) {
+	lock, err := acquireLock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &UUIDSet{name: name, window: window, max: max, lock: lock, added: map[string]time.Time{}}
+	if err := s.load(time.Now()); err != nil {
+		_ = lock.release()
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		_ = lock.release()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *UUIDSet) load(now time.Time) error {
+	file, err := os.Open(s.name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open UUID file: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// A torn last line is ignored.
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read UUID file: %w", err)
+		}
+		i := strings.IndexByte(line, '\t')
+		if i < 0 {
+			continue
+		}
+		nanos, err := strconv.ParseInt(line[:i], 10, 64)
+		if err != nil {
+			continue
+		}
+		s.add(strings.TrimRight(line[i+1:], "\r\n"), time.Unix(0, nanos), now)
+	}
+	return nil
+}
+
+// compact rewrites the file with the UUIDs of the set, and reopens it for
+// appending.
+func (s *UUIDSet) compact() error {
+	var b bytes.Buffer
+	for _, e := range s.entries {
+		b.WriteString(formatUUIDEntry(e))
+	}
+	if err := writeFileSync(s.name+".tmp", b.Bytes()); err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			return fmt.Errorf("failed to close UUID file: %w", err)
+		}
+		s.file = nil
+	}
+	if err := os.Rename(s.name+".tmp", s.name); err != nil {
+		return fmt.Errorf("failed to replace UUID file: %w", err)
+	}
+	syncDir(filepath.Dir(s.name))
+
+	file, err := os.OpenFile(s.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open UUID file: %w", err)
+	}
+	s.file, s.lines = file, len(s.entries)
+	return nil
+}
+
+// Contains reports whether uuid was added in the last window.
+func (s *UUIDSet) Contains(uuid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	added, ok := s.added[uuid]
+	return ok && time.Since(added) < s.window
+}
+
+// Add adds uuids to the set, with a single write to the file. The file is not
+// synced, UUIDs added just before the host crashes may be lost.
+func (s *UUIDSet) Add(uuids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var b strings.Builder
+	var added []string
+	batch := make(map[string]bool, len(uuids))
+	for _, uuid := range uuids {
+		if _, ok := s.added[uuid]; ok || batch[uuid] {
+			continue
+		}
+		batch[uuid] = true
+		b.WriteString(formatUUIDEntry(uuidEntry{uuid: uuid, added: now}))
+		added = append(added, uuid)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	if s.file == nil {
+		return fmt.Errorf("UUID file %s is closed", s.name)
+	}
+	if _, err := s.file.WriteString(b.String()); err != nil {
+		return fmt.Errorf("failed to save UUIDs: %w", err)
+	}
+	s.lines += len(added)
+	for _, uuid := range added {
+		s.add(uuid, now, now)
+	}
+
+	if s.lines > 2*s.max {
+		return s.compact()
+	}
+	return nil
+}
+
+// Len returns the number of UUIDs in the set.
+func (s *UUIDSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.added)
+}
+
+// add adds uuid, added at the given time, to the set in memory, and drops the
+// UUIDs that are too old or too many. s.mu must be held.
+func (s *UUIDSet) add(uuid string, added, now time.Time) {
+	if now.Sub(added) >= s.window {
+		return
+	}
+	if _, ok := s.added[uuid]; !ok {
+		s.added[uuid] = added
+		s.entries = append(s.entries, uuidEntry{uuid: uuid, added: added})
+	}
+
+	for len(s.entries) > 0 && (len(s.entries) > s.max || now.Sub(s.entries[0].added) >= s.window) {
+		delete(s.added, s.entries[0].uuid)
+		s.entries = s.entries[1:]
+	}
+}
+
+func (s *UUIDSet) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.file != nil {
+		err = s.file.Close()
+		s.file = nil
+	}
+	if releaseErr := s.lock.release(); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+func formatUUIDEntry(e uuidEntry) string {
+	return strconv.FormatInt(e.added.UnixNano(), 10) + "\t" + e.uuid + "\n"
+}
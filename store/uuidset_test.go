@@ -0,0 +1,160 @@
+package store_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.1password.io/eventsapibeat/store"
+)
+
+// uuidLine returns the line of uuid, added at the given time, in a UUID file.
+func uuidLine(uuid string, added time.Time) string {
+	return fmt.Sprintf("%d\t%s\n", added.UnixNano(), uuid)
+}
+
+func countLines(t *testing.T, name string) int {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(b), "\n")
+}
+
+func TestUUIDSetMaxEntries(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "uuids")
+	s, err := store.OpenUUIDSet(name, time.Hour, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Add("a", "b", "c", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+	if s.Contains("a") {
+		t.Error("Contains(a) = true, want the oldest UUID dropped")
+	}
+	for _, uuid := range []string{"b", "c", "d"} {
+		if !s.Contains(uuid) {
+			t.Errorf("Contains(%s) = false, want true", uuid)
+		}
+	}
+}
+
+func TestUUIDSetWindow(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "uuids")
+	now := time.Now()
+	content := uuidLine("expired", now.Add(-2*time.Hour)) + uuidLine("recent", now.Add(-time.Minute))
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.OpenUUIDSet(name, time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Contains("expired") {
+		t.Error("Contains(expired) = true, want UUIDs added before the window dropped")
+	}
+	if !s.Contains("recent") {
+		t.Error("Contains(recent) = false, want true")
+	}
+	if n := countLines(t, name); n != 1 {
+		t.Errorf("UUID file holds %d lines once opened, want 1", n)
+	}
+}
+
+func TestUUIDSetWindowExpiry(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "uuids")
+	s, err := store.OpenUUIDSet(name, 50*time.Millisecond, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Add("a"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Contains("a") {
+		t.Fatal("Contains(a) = false, want true")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s.Contains("a") {
+		t.Error("Contains(a) = true after the window, want false")
+	}
+}
+
+func TestUUIDSetCompaction(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "uuids")
+	s, err := store.OpenUUIDSet(name, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i, uuid := range []string{"a", "b", "c", "d"} {
+		if err := s.Add(uuid); err != nil {
+			t.Fatal(err)
+		}
+		if n := countLines(t, name); n != i+1 {
+			t.Fatalf("UUID file holds %d lines after %d UUIDs, want %d", n, i+1, i+1)
+		}
+	}
+	// The fifth line is more than twice the size of the set.
+	if err := s.Add("e"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countLines(t, name); n != 2 {
+		t.Errorf("UUID file holds %d lines once compacted, want 2", n)
+	}
+	if !s.Contains("d") || !s.Contains("e") {
+		t.Error("compaction dropped the latest UUIDs")
+	}
+}
+
+func TestUUIDSetTornLine(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "uuids")
+	now := time.Now()
+	torn := strings.TrimSuffix(uuidLine("torn", now), "\n")
+	if err := os.WriteFile(name, []byte(uuidLine("a", now)+torn), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.OpenUUIDSet(name, time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Contains("torn") {
+		t.Error("Contains(torn) = true, want the torn last line ignored")
+	}
+	if err := s.Add("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = store.OpenUUIDSet(name, time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, uuid := range []string{"a", "b"} {
+		if !s.Contains(uuid) {
+			t.Errorf("Contains(%s) = false after reopening, want true", uuid)
+		}
+	}
+	if n := s.Len(); n != 2 {
+		t.Errorf("Len() = %d after reopening, want 2", n)
+	}
+}